@@ -12,8 +12,8 @@ import (
 func init() {
 	rand.Seed(time.Now().UnixNano() + int64(os.Getpid()+os.Getppid()))
 
-	// 全局设置树节点ID，一般是模块节点的ID
-	statsd.SetDefaultNs("18")
+	// 显式初始化，设置树节点ID，一般是模块节点的ID
+	statsd.MustInit(statsd.Config{Ns: "18"})
 }
 
 func rpcWrapper(rpcSrv string) {
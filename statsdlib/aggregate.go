@@ -0,0 +1,267 @@
+package statsdlib
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/***************************************************************************
+ * 客户端预聚合: 同一个key的上报先在内存里聚合, 每个interval每个key只发一条
+ *   c/ce     : key为(SeriesKey, aggregator), 发送累加和, 格式与单条上报一致
+ *              ce 在agent端按秒统计max/min/avg, 使用ce时interval不要超过1s
+ *   rpc/rpce : key再加上code, 发送调用次数、失败次数和耗时分布, 见 aggregate_rpc.go
+ **************************************************************************/
+const (
+	aggrShardCnt = 16
+
+	DefaultAggrInterval = time.Second
+)
+
+var (
+	counterAggregators = []string{"c", "ce"}
+	rpcAggregators     = []string{"rpc", "rpce"}
+)
+
+// 一个key的聚合结果, p 为该key第一次上报的拷贝
+type aggrEntry struct {
+	p point
+
+	// c/ce
+	sum int64
+
+	// rpc/rpce, 见 aggregate_rpc.go
+	count   int64
+	errors  int64
+	sumMs   int64
+	buckets map[int64]int64
+}
+
+type aggrShard struct {
+	mu      sync.Mutex
+	entries map[string]*aggrEntry
+}
+
+type aggregator struct {
+	aggregators []string
+	shards      [aggrShardCnt]aggrShard
+
+	send   func([]byte) error
+	logger logger
+
+	stop   chan struct{}
+	done   chan struct{}
+	closed atomic.Bool
+	abort  atomic.Bool  // 关闭超时, 取出的聚合结果不再发送
+	unsent atomic.Int64 // 已从shard取出、还没交给send的条数
+}
+
+func newAggregator(aggregators []string, interval time.Duration, send func([]byte) error, lg logger) *aggregator {
+	if interval <= 0 {
+		interval = DefaultAggrInterval
+	}
+	a := &aggregator{
+		aggregators: aggregators,
+		send:        send,
+		logger:      lg,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	for i := range a.shards {
+		a.shards[i].entries = map[string]*aggrEntry{}
+	}
+	go a.loop(interval)
+	return a
+}
+
+// 是否可以预聚合
+func (this *aggregator) accept(p *point) bool {
+	if p.percentiles != nil {
+		return false
+	}
+	for _, aggr := range this.aggregators {
+		if p.aggregator == aggr {
+			return true
+		}
+	}
+	return false
+}
+
+// 聚合一次上报, 调用前需保证 accept(p); 已有的key不分配内存
+func (this *aggregator) add(p *point) error {
+	return this.addSeries(p, nil)
+}
+
+// 同 add, series为已编码好的序列, nil时由point编码
+func (this *aggregator) addSeries(p *point, series []byte) error {
+	rpc := p.aggregator == "rpc" || p.aggregator == "rpce"
+	if rpc && p.kind == valueRaw {
+		err := p.parseRpcValue()
+		if err != nil {
+			return err
+		}
+	}
+	if !rpc && p.kind == valueRaw {
+		cnt, err := strconv.ParseInt(p.sval, 10, 64)
+		if err != nil {
+			return err
+		}
+		p.kind, p.ival = valueInt, cnt
+	}
+
+	// 聚合key: 序列 + aggregator (+ rpc code)
+	buf := getBuf()
+	defer putBuf(buf)
+	key := *buf
+	if series == nil {
+		key = p.appendSeries(key)
+	} else {
+		key = append(key, series...)
+	}
+	key = append(key, '\n')
+	key = append(key, p.aggregator...)
+	if rpc {
+		key = append(key, '\n')
+		key = p.appendCode(key)
+	}
+	*buf = key
+	shard := &this.shards[shardIndex(key)]
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	entry, found := shard.entries[string(key)]
+	if !found {
+		entry = newAggrEntry(p)
+		shard.entries[string(key)] = entry
+	}
+	if rpc {
+		entry.addRpc(p)
+	} else {
+		entry.sum += p.ival
+	}
+	return nil
+}
+
+// 把聚合结果发出去, 每个key一条
+func (this *aggregator) flush() error {
+	return this.flushCtx(context.Background())
+}
+
+// 同 flush, ctx结束后不再处理剩下的shard, 留到下次flush
+func (this *aggregator) flushCtx(ctx context.Context) error {
+	var lastErr error
+	for i := range this.shards {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		shard := &this.shards[i]
+
+		shard.mu.Lock()
+		entries := shard.entries
+		shard.entries = make(map[string]*aggrEntry, len(entries))
+		this.unsent.Add(int64(len(entries)))
+		shard.mu.Unlock()
+
+		for _, entry := range entries {
+			if this.abort.Load() {
+				return ctx.Err()
+			}
+			this.unsent.Add(-1)
+			err := this.send(entry.build())
+			if err != nil {
+				lastErr = err
+			}
+		}
+	}
+	return lastErr
+}
+
+func (this *aggregator) loop(interval time.Duration) {
+	defer close(this.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := this.flush()
+			if err != nil {
+				this.logger.Erro("metrics aggregation flush error", "err", err)
+			}
+		case <-this.stop:
+			return
+		}
+	}
+}
+
+// 停止定时flush, 并发出剩余的聚合结果
+func (this *aggregator) close() error {
+	_, err := this.closeCtx(context.Background())
+	return err
+}
+
+// 同 close, ctx结束时丢弃没有发出的聚合结果, 返回丢弃的条数;
+// 卡在send上的flush留在后台, 正在发送的一条不计入
+func (this *aggregator) closeCtx(ctx context.Context) (int, error) {
+	if this.closed.Swap(true) {
+		return 0, nil
+	}
+	close(this.stop)
+	var err error
+	if waitErr := waitCtx(ctx, func() {
+		<-this.done
+		err = this.flushCtx(ctx)
+	}); waitErr != nil {
+		return this.discard(), waitErr
+	}
+	if ctx.Err() == nil {
+		return 0, err
+	}
+	return this.discard(), err
+}
+
+// 清空所有聚合结果, 之后取出的也不再发送, 返回清掉和取出未发送的条数
+func (this *aggregator) discard() int {
+	this.abort.Store(true)
+	cnt := 0
+	for i := range this.shards {
+		shard := &this.shards[i]
+		shard.mu.Lock()
+		cnt += len(shard.entries)
+		shard.entries = map[string]*aggrEntry{}
+		shard.mu.Unlock()
+	}
+	// 清空之后再读, 清空前被flush取走的也能计入
+	return cnt + int(this.unsent.Load())
+}
+
+// 拷贝point, 之后调用方修改tags不影响聚合结果
+func newAggrEntry(p *point) *aggrEntry {
+	entry := &aggrEntry{p: *p}
+	entry.p.setTags(p.mergedTags())
+	if entry.p.kind == valueRpc {
+		entry.buckets = map[int64]int64{}
+	}
+	return entry
+}
+
+func (this *aggrEntry) build() []byte {
+	if this.p.kind == valueRpc {
+		return this.buildRpc()
+	}
+	p := this.p
+	p.ival = this.sum
+	return p.appendRecord(nil)
+}
+
+// fnv-1a
+func shardIndex(key []byte) int {
+	h := uint32(2166136261)
+	for _, c := range key {
+		h ^= uint32(c)
+		h *= 16777619
+	}
+	return int(h % aggrShardCnt)
+}
@@ -0,0 +1,92 @@
+package statsdlib
+
+import (
+	"fmt"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/***************************************************************************
+ * rpc/rpce 预聚合: 同一个(ns, metric, caller, callee, tags, code)的调用聚合为
+ * 调用次数、失败次数和耗时分布, 以新的aggregator rpcs/rpces 发送, value格式:
+ *   <count>,<errors>,<latency_sum_ms>,<ms>:<n>;<ms>:<n>...,<code>
+ * 耗时分布中 <ms> 小于128时为精确值, 否则只保留高7位(相对误差<1%);
+ * agent 按分布展开后得到的 rpc.counter, rpc.error.ratio, rpc.latency
+ * 与逐条上报 rpc/rpce 等价
+ **************************************************************************/
+const (
+	rpcSummarySuffix = "s"
+	latencyExactMax  = 128
+	latencySigBits   = 7
+)
+
+func (this *aggrEntry) addRpc(p *point) {
+	this.count++
+	if p.fail {
+		this.errors++
+	}
+	this.sumMs += p.ival
+	this.buckets[latencyBucket(p.ival)]++
+}
+
+func (this *aggrEntry) buildRpc() []byte {
+	lats := make([]int64, 0, len(this.buckets))
+	for ms := range this.buckets {
+		lats = append(lats, ms)
+	}
+	sort.Slice(lats, func(i, j int) bool { return lats[i] < lats[j] })
+
+	dist := make([]string, 0, len(lats))
+	for _, ms := range lats {
+		dist = append(dist, fmt.Sprintf("%d:%d", ms, this.buckets[ms]))
+	}
+
+	p := this.p
+	p.kind = valueRaw
+	p.sval = fmt.Sprintf("%d,%d,%d,%s,%s", this.count, this.errors, this.sumMs, strings.Join(dist, ";"), this.p.appendCode(nil))
+	p.aggregator = this.p.aggregator + rpcSummarySuffix
+	return p.appendRecord(nil)
+}
+
+// 解析metricBuilder中原始的rpc value
+func (this *point) parseRpcValue() error {
+	latency, code, fail, err := splitRpcValue(this.sval)
+	if err != nil {
+		return err
+	}
+	this.kind, this.ival, this.sval, this.fail = valueRpc, latency, code, fail
+	return nil
+}
+
+// rpc value 格式为 <latency_ms>,<code>[,<success>]
+// success 为 true/false, 省略时按 successCodes 判断, 返回是否失败
+func splitRpcValue(value string) (int64, string, bool, error) {
+	parts := strings.SplitN(value, ",", 3)
+	if len(parts) < 2 {
+		return 0, "", false, fmt.Errorf("bad rpc value: %s", value)
+	}
+	latency, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, "", false, fmt.Errorf("bad rpc latency: %s", value)
+	}
+	code := parts[1]
+	if len(parts) == 2 {
+		return latency, code, !successCodes[code], nil
+	}
+	success, err := strconv.ParseBool(parts[2])
+	if err != nil {
+		return 0, "", false, fmt.Errorf("bad rpc success: %s", value)
+	}
+	return latency, code, !success, nil
+}
+
+// 耗时分桶, 小于128ms时为精确值, 否则只保留高7位, 取桶的中间值
+func latencyBucket(ms int64) int64 {
+	if ms < latencyExactMax {
+		return ms
+	}
+	shift := bits.Len64(uint64(ms)) - latencySigBits
+	return (ms>>shift)<<shift + (1<<shift)/2
+}
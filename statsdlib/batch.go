@@ -0,0 +1,166 @@
+package statsdlib
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/***************************************************************************
+ * 批量发送: 多条metric打包到一个udp包里, 按大小或者定时flush
+ * 打包格式(framing), 每条记录前面是它的字节数:
+ *   \x1ebatch\n
+ *   <len>\n<record>
+ *   <len>\n<record>
+ *   ...
+ * record 即 Build() 的结果; 一个包里只有一条记录时按原格式发送, 不加framing
+ * 打包头以控制字符 0x1e 开头, 记录中的控制字符都是非法字符(见 charset.go),
+ * 因此单条记录不会被误认为打包格式, 例如 Ratio("m", "#batch")
+ **************************************************************************/
+const (
+	batchHeader = "\x1ebatch\n"
+
+	DefaultBatchMTU      = 1432                   // 以太网下udp payload安全大小
+	LoopbackBatchMTU     = 8192                   // 发往本机agent时可以用大一些的包
+	DefaultBatchInterval = 100 * time.Millisecond // 定时flush间隔
+)
+
+type batcher struct {
+	mu       sync.Mutex
+	buf      []byte
+	cnt      int // 当前包里的记录数
+	firstOff int // 第一条记录的起始位置
+	mtu      int
+	drained  bool // 关闭时最后一次flush已完成
+
+	oversized atomic.Uint64 // 超过mtu单独发送的记录条数
+
+	send   func([]byte) error
+	logger logger
+
+	stop   chan struct{}
+	done   chan struct{}
+	closed atomic.Bool
+}
+
+func newBatcher(mtu int, interval time.Duration, send func([]byte) error, lg logger) *batcher {
+	if mtu <= 0 {
+		mtu = DefaultBatchMTU
+	}
+	if interval <= 0 {
+		interval = DefaultBatchInterval
+	}
+	b := &batcher{
+		buf:    make([]byte, 0, mtu),
+		mtu:    mtu,
+		send:   send,
+		logger: lg,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go b.loop(interval)
+	return b
+}
+
+// 加入一条记录, 包满时先把已有的发出去
+func (this *batcher) add(record []byte) error {
+	size := len(strconv.Itoa(len(record))) + 1 + len(record)
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	// 关闭后才到达的记录(如关闭超时时异步队列中正在发送的一条)没有人再flush, 直接发
+	if this.drained {
+		return this.send(record)
+	}
+
+	// 单条就超过了mtu, 不打包直接发
+	if len(batchHeader)+size > this.mtu {
+		this.oversized.Add(1)
+		err := this.flushLocked()
+		if err2 := this.send(record); err2 != nil {
+			err = err2
+		}
+		return err
+	}
+
+	var err error
+	if this.cnt > 0 && len(this.buf)+size > this.mtu {
+		err = this.flushLocked()
+	}
+	if this.cnt == 0 {
+		this.buf = append(this.buf[:0], batchHeader...)
+	}
+	this.buf = strconv.AppendInt(this.buf, int64(len(record)), 10)
+	this.buf = append(this.buf, '\n')
+	if this.cnt == 0 {
+		this.firstOff = len(this.buf)
+	}
+	this.buf = append(this.buf, record...)
+	this.cnt++
+	return err
+}
+
+func (this *batcher) flush() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.flushLocked()
+}
+
+func (this *batcher) flushLocked() error {
+	if this.cnt == 0 {
+		return nil
+	}
+	body := this.buf
+	if this.cnt == 1 {
+		body = this.buf[this.firstOff:]
+	}
+	err := this.send(body)
+	this.buf = this.buf[:0]
+	this.cnt = 0
+	return err
+}
+
+func (this *batcher) loop(interval time.Duration) {
+	defer close(this.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := this.flush()
+			if err != nil {
+				this.logger.Erro("metrics batch flush error", "err", err)
+			}
+		case <-this.stop:
+			return
+		}
+	}
+}
+
+// 停止定时flush, 并发出剩余的记录
+func (this *batcher) close() error {
+	return this.closeCtx(context.Background())
+}
+
+// 同 close, 最多等到ctx结束; 卡在send上的包留在后台发完, 不计入丢失
+func (this *batcher) closeCtx(ctx context.Context) error {
+	if this.closed.Swap(true) {
+		return nil
+	}
+	close(this.stop)
+	var err error
+	if waitErr := waitCtx(ctx, func() {
+		<-this.done
+		this.mu.Lock()
+		defer this.mu.Unlock()
+		err = this.flushLocked()
+		this.drained = true
+	}); waitErr != nil {
+		return waitErr
+	}
+	return err
+}
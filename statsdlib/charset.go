@@ -0,0 +1,160 @@
+package statsdlib
+
+import (
+	"fmt"
+	"strings"
+)
+
+/***************************************************************************
+ * 字符规则: Build() 用 \n 分隔字段, 用 / 分隔ns和metric, 用 = 分隔tagk和tagv,
+ * 以下字符会破坏协议, 视为非法:
+ *   所有字段   : 控制字符(0x00-0x1f, 0x7f), 包括 \n \r \t
+ *   ns         : 另外还有 /
+ *   tagk, tagv : 另外还有 =
+ * rpc的caller/callee即tagv; value和aggregator中的code/分位值也只允许非控制字符,
+ * rpc的code中另外还有 ,
+ **************************************************************************/
+
+// 遇到非法字符时的处理方式
+type CharPolicy int
+
+const (
+	CharLenient CharPolicy = iota // 非法字符替换为 _ (默认)
+	CharStrict                    // 返回错误, 不上报
+)
+
+const (
+	charReplacement = '_'
+
+	nsIllegal  = "/"
+	tagIllegal = "="
+
+	rpcCodeIllegal = ","
+)
+
+func isIllegalChar(c byte, extra string) bool {
+	return c < 0x20 || c == 0x7f || strings.IndexByte(extra, c) >= 0
+}
+
+// 不含非法字符时原样返回, 不分配内存
+func sanitizeField(s string, extra string) (string, bool) {
+	i := 0
+	for i < len(s) && !isIllegalChar(s[i], extra) {
+		i++
+	}
+	if i == len(s) {
+		return s, false
+	}
+
+	b := []byte(s)
+	for ; i < len(b); i++ {
+		if isIllegalChar(b[i], extra) {
+			b[i] = charReplacement
+		}
+	}
+	return string(b), true
+}
+
+// 按policy处理一个字段
+func sanitizeValue(name string, s string, extra string, policy CharPolicy) (string, error) {
+	clean, changed := sanitizeField(s, extra)
+	if changed && policy == CharStrict {
+		return s, fmt.Errorf("%w in %s: %q", ErrIllegalChar, name, s)
+	}
+	return clean, nil
+}
+
+// rpc value 用 , 分隔code和success, code中的 , 为非法字符
+func (this *point) valueIllegal() string {
+	if this.kind == valueRpc {
+		return rpcCodeIllegal
+	}
+	return ""
+}
+
+// 按policy处理一个tagv, 错误为 *TagError
+func sanitizeTagv(k string, v string, policy CharPolicy) (string, error) {
+	clean, changed := sanitizeField(v, tagIllegal)
+	if changed && policy == CharStrict {
+		return v, &TagError{Key: k, Value: v, Reason: ErrIllegalChar}
+	}
+	return clean, nil
+}
+
+// 按policy处理非法字符, 宽松模式下替换point中的字段, 调用方的tags不会被修改
+func (this *point) sanitize(policy CharPolicy) error {
+	var err error
+	if this.ns, err = sanitizeValue("ns", this.ns, nsIllegal, policy); err != nil {
+		return err
+	}
+	if this.metric, err = sanitizeValue("metric", this.metric, "", policy); err != nil {
+		return err
+	}
+	if this.sval, err = sanitizeValue("value", this.sval, this.valueIllegal(), policy); err != nil {
+		return err
+	}
+	if this.aggregator, err = sanitizeValue("aggregator", this.aggregator, "", policy); err != nil {
+		return err
+	}
+	if this.caller, err = sanitizeTagv("caller", this.caller, policy); err != nil {
+		return err
+	}
+	if this.callee, err = sanitizeTagv("callee", this.callee, policy); err != nil {
+		return err
+	}
+
+	copied := false
+	for i, p := range this.percentiles {
+		clean, changed := sanitizeField(p, ",")
+		if !changed {
+			continue
+		}
+		if policy == CharStrict {
+			return fmt.Errorf("%w in percentile: %q", ErrIllegalChar, p)
+		}
+		// 不修改调用方的slice
+		if !copied {
+			this.percentiles = append([]string(nil), this.percentiles...)
+			copied = true
+		}
+		this.percentiles[i] = clean
+	}
+
+	if this.tags, err = sanitizeTags(this.tags, policy); err != nil {
+		return err
+	}
+	if this.ctxTags, err = sanitizeTags(this.ctxTags, policy); err != nil {
+		return err
+	}
+	return nil
+}
+
+// 没有非法字符时原样返回, 否则返回新的map, 不修改调用方的tags
+func sanitizeTags(tags map[string]string, policy CharPolicy) (map[string]string, error) {
+	dirty := false
+	for k, v := range tags {
+		if _, changed := sanitizeField(k, tagIllegal); changed {
+			if policy == CharStrict {
+				return tags, &TagError{Key: k, Value: v, Reason: ErrIllegalChar}
+			}
+			dirty = true
+		}
+		if _, changed := sanitizeField(v, tagIllegal); changed {
+			if policy == CharStrict {
+				return tags, &TagError{Key: k, Value: v, Reason: ErrIllegalChar}
+			}
+			dirty = true
+		}
+	}
+	if !dirty {
+		return tags, nil
+	}
+
+	clean := make(map[string]string, len(tags))
+	for k, v := range tags {
+		cleanK, _ := sanitizeField(k, tagIllegal)
+		cleanV, _ := sanitizeField(v, tagIllegal)
+		clean[cleanK] = cleanV
+	}
+	return clean, nil
+}
@@ -0,0 +1,520 @@
+package statsdlib
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultAddr = "127.0.0.1:788"
+
+// Client 拥有独立的agent地址、namespace、连接、日志和限制,
+// 多个Client之间互不影响; 包级别的接口使用默认Client
+type Client struct {
+	logger   logger
+	logFile  io.Closer // Client创建的日志文件, 关闭时一起关闭
+	limitPol LimitPolicy
+	limitCnt limitCounters
+	stats    statsCounters
+	chars    CharPolicy
+
+	classifier CodeClassifier
+	logRepeat  time.Duration // 日志限频间隔, 见 WithLogRepeatInterval
+
+	// 可变配置, 见 snapshot.go
+	init     clientConfig // Option设置的初始配置
+	initTags map[string]string
+	cfg      atomic.Pointer[clientConfig]
+	cfgMu    sync.Mutex
+	closed   atomic.Bool
+	pushMu   sync.RWMutex // 上报时持有读锁, Close 等待进行中的上报放入预聚合/队列
+	sendMu   sync.RWMutex // 发送时持有读锁, 关闭Transport前等待正在发送的包
+
+	batchMTU      int
+	batchInterval time.Duration
+	batch         *batcher
+
+	asyncSize    int
+	asyncPolicy  FullPolicy
+	asyncTimeout time.Duration
+	queue        *asyncQueue
+
+	counterAggrInterval time.Duration
+	counterAggr         *aggregator
+	rpcAggrInterval     time.Duration
+	rpcAggr             *aggregator
+
+	selfStatsInterval time.Duration
+	selfStats         *selfStats
+}
+
+type Option func(*Client)
+
+// 设置metrics-agent地址, 默认 127.0.0.1:788
+// 支持 tcp:// unix:// unixgram:// mem:// 等地址, 见 NewTransport
+func WithAddr(addr string) Option {
+	return func(c *Client) {
+		c.init.addr = addr
+	}
+}
+
+// 使用指定的Transport发送, 忽略 WithAddr
+func WithTransport(transport Transport) Option {
+	return func(c *Client) {
+		c.init.transport = transport
+	}
+}
+
+// 设置namespace, 一般是服务树节点
+func WithNs(ns string) Option {
+	return func(c *Client) {
+		c.init.ns = ns
+	}
+}
+
+// 设置日志输出, 默认不输出; 按行输出文本, 见 NewWriterLogger
+func WithLogWriter(w io.Writer) Option {
+	return WithLogger(NewWriterLogger(w))
+}
+
+// 设置日志输出, 默认不输出; 可以使用 NewSlogLogger 接入 log/slog
+func WithLogger(l Logger) Option {
+	return func(c *Client) {
+		c.logger.l = l
+	}
+}
+
+// 设置日志级别, 低于level的日志不输出, 默认 LogInfo
+func WithLogLevel(level LogLevel) Option {
+	return func(c *Client) {
+		c.logger.level = level
+	}
+}
+
+// 相同的Warn/Error日志每interval只输出一次, 之后输出时带上重复次数;
+// interval为0时使用 DefaultLogRepeatInterval, <0 时不限频
+func WithLogRepeatInterval(interval time.Duration) Option {
+	return func(c *Client) {
+		c.logRepeat = interval
+	}
+}
+
+// 设置长度/个数限制, 未设置(<=0)的项使用 DefaultLimits
+func WithLimits(limits Limits) Option {
+	return func(c *Client) {
+		c.init.limits = limits.withDefaults()
+	}
+}
+
+// 设置超出限制时的处理方式, 默认 LimitReject
+func WithLimitPolicy(policy LimitPolicy) Option {
+	return func(c *Client) {
+		c.limitPol = policy
+	}
+}
+
+// 开启批量发送, 多条metric打包到一个不超过mtu字节的udp包, 按大小或interval定时flush
+// mtu 可用 DefaultBatchMTU / LoopbackBatchMTU, interval<=0 时使用 DefaultBatchInterval
+func WithBatch(mtu int, interval time.Duration) Option {
+	return func(c *Client) {
+		c.batchMTU = mtu
+		c.batchInterval = interval
+	}
+}
+
+// 开启异步发送, 上报接口只把metric放入容量为size的队列, 由后台goroutine发送
+// 队列满时按policy处理, policy为Block时最多等待timeout, timeout<=0 时使用 DefaultBlockTimeout
+func WithAsync(size int, policy FullPolicy, timeout time.Duration) Option {
+	return func(c *Client) {
+		c.asyncSize = size
+		c.asyncPolicy = policy
+		c.asyncTimeout = timeout
+	}
+}
+
+// 开启c/ce计数的客户端预聚合, 同一个metric+tags每interval只发一条累加和
+// interval<=0 时使用 DefaultAggrInterval; 使用ce时interval不要超过1s
+func WithCounterAggregation(interval time.Duration) Option {
+	return func(c *Client) {
+		if interval <= 0 {
+			interval = DefaultAggrInterval
+		}
+		c.counterAggrInterval = interval
+	}
+}
+
+// 开启rpc/rpce的客户端预聚合, 同一个metric+caller+callee+code+tags每interval只发一条汇总,
+// aggregator为rpcs/rpces, interval<=0 时使用 DefaultAggrInterval
+func WithRpcAggregation(interval time.Duration) Option {
+	return func(c *Client) {
+		if interval <= 0 {
+			interval = DefaultAggrInterval
+		}
+		c.rpcAggrInterval = interval
+	}
+}
+
+// 设置非法字符的处理方式, 默认 CharLenient
+func WithCharPolicy(policy CharPolicy) Option {
+	return func(c *Client) {
+		c.chars = policy
+	}
+}
+
+// 设置rpc code的归一化规则, 默认 ClassifyCode
+func WithCodeClassifier(classifier CodeClassifier) Option {
+	return func(c *Client) {
+		c.classifier = classifier
+	}
+}
+
+// 设置默认tags, 见 SetDefaultTags
+func WithDefaultTags(tags map[string]string) Option {
+	return func(c *Client) {
+		c.initTags = tags
+	}
+}
+
+func NewClient(opts ...Option) (*Client, error) {
+	c := &Client{
+		init: clientConfig{addr: defaultAddr, limits: DefaultLimits},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.logRepeat == 0 {
+		c.logRepeat = DefaultLogRepeatInterval
+	}
+	if c.logRepeat > 0 {
+		c.logger.limiter = newLogLimiter(c.logRepeat)
+	}
+	cfg := c.init
+	defTags, err := checkDefaultTags(c.initTags, cfg.limits, c.chars)
+	if err != nil {
+		return nil, err
+	}
+	cfg.defTags = defTags
+
+	if cfg.transport == nil {
+		cfg.transport, err = NewTransport(cfg.addr)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		cfg.addr = ""
+	}
+	c.cfg.Store(&cfg)
+
+	if c.batchMTU > 0 {
+		c.batch = newBatcher(c.batchMTU, c.batchInterval, c.write, c.logger)
+	}
+	if c.asyncSize > 0 {
+		c.queue = newAsyncQueue(c.asyncSize, c.asyncPolicy, c.asyncTimeout, c.send, c.logger)
+	}
+	if c.counterAggrInterval > 0 {
+		c.counterAggr = newAggregator(counterAggregators, c.counterAggrInterval, c.send, c.logger)
+	}
+	if c.rpcAggrInterval > 0 {
+		c.rpcAggr = newAggregator(rpcAggregators, c.rpcAggrInterval, c.send, c.logger)
+	}
+	if c.selfStatsInterval > 0 {
+		c.selfStats = newSelfStats(c, c.selfStatsInterval)
+	}
+
+	c.logger.Info("metric transport ready", "addr", cfg.addr)
+	return c, nil
+}
+
+// 超出限制时各处理方式触发的次数
+func (this *Client) LimitStats() LimitStats {
+	return this.limitCnt.stats()
+}
+
+// 异步队列满或者关闭后丢弃的metric个数
+func (this *Client) Dropped() uint64 {
+	if this.queue == nil {
+		return 0
+	}
+	return this.queue.dropped.Load()
+}
+
+/***************************************************************************
+ **********************     Client上报接口        **************************
+ ************   语义与同名的包级别接口一致, 见 metrics.go   ****************
+ **************************************************************************/
+func (this *Client) RpcMetric(metric string, caller string, callee string, latency time.Duration, code interface{}, tags ...map[string]string) error {
+	cfg := this.config()
+	p := this.rpcPoint(cfg, metric, caller, callee, latency, code, DefaultRpcVersion, tags)
+	return this.pushPoint(cfg, &p)
+}
+
+func (this *Client) RpcMetricE(metric string, caller string, callee string, latency time.Duration, code interface{}, tags ...map[string]string) error {
+	cfg := this.config()
+	p := this.rpcPoint(cfg, metric, caller, callee, latency, code, EnhanceRpcVersion, tags)
+	return this.pushPoint(cfg, &p)
+}
+
+func (this *Client) Rpc(caller string, callee string, latency time.Duration, code interface{}, tags ...map[string]string) error {
+	cfg := this.config()
+	p := this.rpcPoint(cfg, "rpc", caller, callee, latency, code, DefaultRpcVersion, tags)
+	return this.pushPoint(cfg, &p)
+}
+
+func (this *Client) RpcE(caller string, callee string, latency time.Duration, code interface{}, tags ...map[string]string) error {
+	cfg := this.config()
+	p := this.rpcPoint(cfg, "rpc", caller, callee, latency, code, EnhanceRpcVersion, tags)
+	return this.pushPoint(cfg, &p)
+}
+
+func (this *Client) Counter(metric string, tags ...map[string]string) error {
+	return this.CounterN(metric, 1, tags...)
+}
+
+func (this *Client) CounterN(metric string, cnt int, tags ...map[string]string) error {
+	cfg := this.config()
+	p := this.counterPoint(cfg, metric, cnt, "c", tags)
+	return this.pushPoint(cfg, &p)
+}
+
+func (this *Client) CounterE(metric string, tags ...map[string]string) error {
+	return this.CounterNE(metric, 1, tags...)
+}
+
+func (this *Client) CounterNE(metric string, cnt int, tags ...map[string]string) error {
+	cfg := this.config()
+	p := this.counterPoint(cfg, metric, cnt, "ce", tags)
+	return this.pushPoint(cfg, &p)
+}
+
+func (this *Client) Gauge(metric string, value float64, tags ...map[string]string) error {
+	cfg := this.config()
+	p := this.gaugePoint(cfg, metric, value, tags)
+	return this.pushPoint(cfg, &p)
+}
+
+func (this *Client) Ratio(metric string, code string) error {
+	cfg := this.config()
+	p := this.ratioPoint(cfg, metric, code, nil)
+	return this.pushPoint(cfg, &p)
+}
+
+func (this *Client) RatioN(metric string, code string, cnt int) error {
+	cfg := this.config()
+	p := this.ratioPoint(cfg, metric, code, []int{cnt})
+	return this.pushPoint(cfg, &p)
+}
+
+func (this *Client) Percentile(metric string, value float64, percentiles []string, tags ...map[string]string) error {
+	if len(percentiles) == 0 {
+		this.stats.addInvalid(ErrNoPercentile)
+		return ErrNoPercentile
+	}
+	cfg := this.config()
+	p := this.percentilePoint(cfg, metric, value, percentiles, tags)
+	return this.pushPoint(cfg, &p)
+}
+
+// points, 在栈上构造, 不复制tags
+func firstTags(tags []map[string]string) map[string]string {
+	if len(tags) > 0 {
+		return tags[0]
+	}
+	return nil
+}
+
+func (this *Client) rpcPoint(cfg *clientConfig, metric string, caller string, callee string, latency time.Duration, code interface{}, version int, tags []map[string]string) point {
+	// caller/callee 过长时总是截断, 见 limits.go
+	caller = trimQuery(caller)
+	callee = trimQuery(callee)
+
+	aggr := "rpc"
+	if version == EnhanceRpcVersion {
+		aggr = "rpce"
+	}
+	p := point{ns: cfg.ns, metric: metric, aggregator: aggr, tags: firstTags(tags),
+		rpcTags: true, caller: caller, callee: callee,
+		kind: valueRpc, ival: latency.Nanoseconds() / 1000000}
+	p.setCode(code, this.classifier)
+	return p
+}
+
+func (this *Client) counterPoint(cfg *clientConfig, metric string, cnt int, aggr string, tags []map[string]string) point {
+	return point{ns: cfg.ns, metric: metric, aggregator: aggr, tags: firstTags(tags), kind: valueInt, ival: int64(cnt)}
+}
+
+func (this *Client) gaugePoint(cfg *clientConfig, metric string, value float64, tags []map[string]string) point {
+	return point{ns: cfg.ns, metric: metric, aggregator: "g", tags: firstTags(tags), kind: valueFloat, fval: value}
+}
+
+func (this *Client) ratioPoint(cfg *clientConfig, metric string, code string, cnt []int) point {
+	p := point{ns: cfg.ns, metric: metric, aggregator: "rt", kind: valueRatio, sval: code}
+	if len(cnt) == 1 {
+		p.kind, p.ival = valueRatioN, int64(cnt[0])
+	}
+	return p
+}
+
+func (this *Client) percentilePoint(cfg *clientConfig, metric string, value float64, percentiles []string, tags []map[string]string) point {
+	return point{ns: cfg.ns, metric: metric, percentiles: percentiles, tags: firstTags(tags), kind: valueFloat, fval: value}
+}
+
+// builders, 由point转换而来, tags是独立的拷贝
+func (this *Client) builder(cfg *clientConfig, p point) *metricBuilder {
+	p.defTags = cfg.defTags
+	mb := metricBuilder{}.Name(p.metric).Ns(p.ns).Agg(string(p.appendValue(nil)), string(p.appendAggregator(nil)))
+	mb.Tags = p.mergedTags()
+	mb.client = this
+	return mb
+}
+
+func (this *Client) rpcMetricBuilder(metric string, caller string, callee string, latency time.Duration, code interface{}, version int, tags ...map[string]string) *metricBuilder {
+	cfg := this.config()
+	return this.builder(cfg, this.rpcPoint(cfg, metric, caller, callee, latency, code, version, tags))
+}
+
+func (this *Client) counterNBuilder(metric string, cnt int, tags ...map[string]string) *metricBuilder {
+	cfg := this.config()
+	return this.builder(cfg, this.counterPoint(cfg, metric, cnt, "c", tags))
+}
+
+func (this *Client) counterNEBuilder(metric string, cnt int, tags ...map[string]string) *metricBuilder {
+	cfg := this.config()
+	return this.builder(cfg, this.counterPoint(cfg, metric, cnt, "ce", tags))
+}
+
+func (this *Client) gaugeBuilder(metric string, value float64, tags ...map[string]string) *metricBuilder {
+	cfg := this.config()
+	return this.builder(cfg, this.gaugePoint(cfg, metric, value, tags))
+}
+
+func (this *Client) ratioBuilder(metric string, code string, cnt ...int) *metricBuilder {
+	cfg := this.config()
+	return this.builder(cfg, this.ratioPoint(cfg, metric, code, cnt))
+}
+
+func (this *Client) percentileBuilder(metric string, value float64, percentiles []string, tags ...map[string]string) *metricBuilder {
+	cfg := this.config()
+	return this.builder(cfg, this.percentilePoint(cfg, metric, value, percentiles, tags))
+}
+
+func (this *Client) push(mb *metricBuilder) error {
+	p := mb.point()
+	return this.pushPoint(this.config(), &p)
+}
+
+// 校验、预聚合、编码并发送, cfg为构造point时读取的配置快照
+func (this *Client) pushPoint(cfg *clientConfig, p *point) (err error) {
+	defer this.recoverPanic(&err)
+
+	// 默认tags
+	p.defTags = cfg.defTags
+
+	// 非法字符
+	err = p.sanitize(this.chars)
+	if err != nil {
+		this.stats.addInvalid(err)
+		return err
+	}
+
+	// check
+	fit, err := p.checkLimits(cfg.limits, this.limitPol)
+	this.limitCnt.record(fit, err)
+	if err != nil {
+		this.stats.addInvalid(err)
+		return err
+	}
+	return this.emit(p, nil)
+}
+
+// 发送已经校验过的point, series为缓存的序列编码, 见 handle.go
+func (this *Client) pushPrepared(p *point, series []byte) (err error) {
+	defer this.recoverPanic(&err)
+	return this.emit(p, series)
+}
+
+func (this *Client) recoverPanic(err *error) {
+	if r := recover(); r != nil {
+		this.stats.panics.Add(1)
+		this.logger.Erro("metrics push panic", "panic", r)
+		*err = fmt.Errorf("metrics push panic: %v", r)
+	}
+}
+
+// 预聚合、编码并发送, series为nil时由point编码
+func (this *Client) emit(p *point, series []byte) error {
+	// Close等待进行中的上报超时后, pushMu的写锁可能还在排队, 已关闭时不再等读锁
+	if this.closed.Load() {
+		return ErrClosed
+	}
+	this.pushMu.RLock()
+	defer this.pushMu.RUnlock()
+	if this.closed.Load() {
+		return ErrClosed
+	}
+	this.stats.built.Add(1)
+
+	// 预聚合
+	if this.counterAggr != nil && this.counterAggr.accept(p) {
+		return this.counterAggr.addSeries(p, series)
+	}
+	if this.rpcAggr != nil && this.rpcAggr.accept(p) {
+		return this.rpcAggr.addSeries(p, series)
+	}
+
+	// build
+	buf := getBuf()
+	if series == nil {
+		*buf = p.appendRecord(*buf)
+	} else {
+		*buf = p.appendRecordSeries(*buf, series)
+	}
+
+	// send, 异步发送时buffer由队列归还
+	if this.queue != nil {
+		return this.queue.put(buf)
+	}
+	err := this.send(*buf)
+	putBuf(buf)
+	return err
+}
+
+// 批量发送或者直接发送
+func (this *Client) send(record []byte) error {
+	if this.batch != nil {
+		return this.batch.add(record)
+	}
+	return this.write(record)
+}
+
+// 发送一个udp包/一帧
+// 异步/批量/预聚合时由后台goroutine调用, 自定义Transport panic时按发送失败处理
+func (this *Client) write(body []byte) (err error) {
+	transport := this.config().transport
+	if transport == nil {
+		return fmt.Errorf("client not init")
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			this.stats.panics.Add(1)
+			this.stats.sendErrors.Add(1)
+			this.stats.sendLost.Add(uint64(recordCount(body)))
+			this.logger.Erro("metrics send panic", "panic", r)
+			err = fmt.Errorf("metrics send panic: %v", r)
+		}
+	}()
+
+	this.sendMu.RLock()
+	defer this.sendMu.RUnlock()
+	err = transport.Send(body)
+	if err != nil {
+		this.countOversized(err)
+		this.stats.sendErrors.Add(1)
+		this.stats.sendLost.Add(uint64(recordCount(body)))
+		return err
+	}
+	this.stats.sent.Add(uint64(recordCount(body)))
+	this.stats.sentBytes.Add(uint64(len(body)))
+	return nil
+}
@@ -0,0 +1,453 @@
+package statsdlib
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 本地起一个udp端口模拟metrics-agent
+func listenAgent(t *testing.T) *net.UDPConn {
+	addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:0")
+	conn, err := net.ListenUDP("udp4", addr)
+	if err != nil {
+		t.Fatalf("listen udp error: %s", err.Error())
+	}
+	return conn
+}
+
+func readAgent(t *testing.T, conn *net.UDPConn) string {
+	buf := make([]byte, 65536)
+	conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("read udp error: %s", err.Error())
+	}
+	return string(buf[:n])
+}
+
+func TestClientIsolation(t *testing.T) {
+	agent := listenAgent(t)
+	defer agent.Close()
+
+	c1, err := NewClient(WithAddr(agent.LocalAddr().String()), WithNs("ns1"))
+	if err != nil {
+		t.Fatalf("new client error: %s", err.Error())
+	}
+	defer c1.Close(context.Background())
+	c2, err := NewClient(WithAddr(agent.LocalAddr().String()), WithNs("ns2"))
+	if err != nil {
+		t.Fatalf("new client error: %s", err.Error())
+	}
+	defer c2.Close(context.Background())
+
+	if err := c1.Counter("c.test"); err != nil {
+		t.Errorf("push error: %s", err.Error())
+	}
+	if body := readAgent(t, agent); body != "1\nns1/c.test\nc" {
+		t.Errorf("bad body: %q", body)
+	}
+
+	if err := c2.Gauge("g.test", 1.5); err != nil {
+		t.Errorf("push error: %s", err.Error())
+	}
+	if body := readAgent(t, agent); body != "1.500000\nns2/g.test\ng" {
+		t.Errorf("bad body: %q", body)
+	}
+}
+
+func TestClientLimits(t *testing.T) {
+	c, err := NewClient(WithNs("ns"), WithLimits(Limits{MaxTagkLen: 4, MaxTagvLen: 4, MaxTagCnt: 1, MaxMetricLen: 4}))
+	if err != nil {
+		t.Fatalf("new client error: %s", err.Error())
+	}
+	defer c.Close(context.Background())
+
+	err = c.Counter("metric")
+	if !(err != nil && strings.Contains(err.Error(), "metric too long")) {
+		t.Errorf("bad metric limit: %v", err)
+	}
+	err = c.Counter("m", map[string]string{"k1": "v", "k2": "v"})
+	if !(err != nil && strings.Contains(err.Error(), "too many tags")) {
+		t.Errorf("bad tag cnt limit: %v", err)
+	}
+}
+
+func TestClientClosed(t *testing.T) {
+	c, err := NewClient(WithNs("ns"))
+	if err != nil {
+		t.Fatalf("new client error: %s", err.Error())
+	}
+	c.Close(context.Background())
+	if err := c.Counter("m"); err == nil {
+		t.Errorf("push on closed client should fail")
+	}
+}
+
+// 没有配置ns时与原来一样发送 /metric
+func TestClientEmptyNs(t *testing.T) {
+	tr := NewMemTransport()
+	c, _ := NewClient(WithTransport(tr))
+	defer c.Close(context.Background())
+
+	if err := c.Counter("m"); err != nil {
+		t.Fatalf("push without ns: %v", err)
+	}
+	h := c.NewCounter("h")
+	if err := h.Inc(); err != nil {
+		t.Fatalf("handle without ns: %v", err)
+	}
+	p := tr.Payloads()
+	if len(p) != 2 || string(p[0]) != "1\n/m\nc" || string(p[1]) != "1\n/h\nc" {
+		t.Errorf("bad payloads: %q", p)
+	}
+}
+
+func TestConfigLoadFiles(t *testing.T) {
+	wd := t.TempDir()
+
+	// 缺少 .deploy 时返回错误
+	_, err := Config{LoadFiles: true, WorkDir: wd}.newClient()
+	if !(err != nil && strings.Contains(err.Error(), "service meta init error")) {
+		t.Errorf("missing meta should fail: %v", err)
+	}
+
+	// 显式设置ns时允许缺少 .deploy
+	c, err := Config{LoadFiles: true, WorkDir: wd, Ns: "explicit"}.newClient()
+	if err != nil {
+		t.Fatalf("new client error: %s", err.Error())
+	}
+	c.Close(context.Background())
+	if c.Ns() != "explicit" {
+		t.Errorf("bad ns: %s", c.Ns())
+	}
+
+	os.MkdirAll(filepath.Join(wd, ".deploy"), 0755)
+	os.MkdirAll(filepath.Join(wd, ".statsd"), 0755)
+	os.WriteFile(filepath.Join(wd, ".deploy", "service.service_name.txt"), []byte("user_service\n"), 0644)
+	os.WriteFile(filepath.Join(wd, ".deploy", "service.module.txt"), []byte("user"), 0644)
+	os.WriteFile(filepath.Join(wd, ".deploy", "service.cluster.txt"), []byte("bj"), 0644)
+	os.WriteFile(filepath.Join(wd, ".statsd", "statsd.cfg.txt"), []byte("127.0.0.1:8788"), 0644)
+
+	c, err = Config{LoadFiles: true, WorkDir: wd}.newClient()
+	if err != nil {
+		t.Fatalf("new client error: %s", err.Error())
+	}
+	c.Close(context.Background())
+	if c.Ns() != "bj.user_service" {
+		t.Errorf("bad ns: %s", c.Ns())
+	}
+	if c.Addr() != "127.0.0.1:8788" {
+		t.Errorf("bad addr: %s", c.Addr())
+	}
+	if _, err := os.Stat(filepath.Join(wd, ".statsd", "statsd.log")); err == nil {
+		t.Errorf("log file should not be created")
+	}
+}
+
+func TestConfigNoFiles(t *testing.T) {
+	wd := t.TempDir()
+	c, err := Config{Ns: "ns", WorkDir: wd}.newClient()
+	if err != nil {
+		t.Fatalf("new client error: %s", err.Error())
+	}
+	c.Close(context.Background())
+
+	entries, _ := os.ReadDir(wd)
+	if len(entries) != 0 {
+		t.Errorf("work dir should be untouched: %v", entries)
+	}
+}
+
+func TestBatcher(t *testing.T) {
+	var sent []string
+	send := func(body []byte) error {
+		sent = append(sent, string(body))
+		return nil
+	}
+	b := newBatcher(30, time.Hour, send, logger{})
+
+	b.add([]byte("1\nns/a\nc"))
+	b.add([]byte("1\nns/b\nc"))
+	if len(sent) != 0 {
+		t.Errorf("should not send before full: %q", sent)
+	}
+	// 第三条放不下, 先发出前两条
+	b.add([]byte("1\nns/c\nc"))
+	if len(sent) != 1 || sent[0] != "\x1ebatch\n8\n1\nns/a\nc8\n1\nns/b\nc" {
+		t.Errorf("bad batch: %q", sent)
+	}
+	// 超过mtu的单条直接发
+	big := "1\nns/" + strings.Repeat("x", 30) + "\nc"
+	b.add([]byte(big))
+	if len(sent) != 3 || sent[1] != "1\nns/c\nc" || sent[2] != big {
+		t.Errorf("bad oversized send: %q", sent)
+	}
+
+	// 只有一条时按原格式
+	b.add([]byte("1\nns/d\nc"))
+	b.close()
+	if len(sent) != 4 || sent[3] != "1\nns/d\nc" {
+		t.Errorf("bad single flush: %q", sent)
+	}
+}
+
+func TestClientBatchInterval(t *testing.T) {
+	agent := listenAgent(t)
+	defer agent.Close()
+
+	c, err := NewClient(WithAddr(agent.LocalAddr().String()), WithNs("ns"), WithBatch(LoopbackBatchMTU, 10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("new client error: %s", err.Error())
+	}
+	defer c.Close(context.Background())
+
+	c.Counter("a")
+	c.Counter("b")
+	if body := readAgent(t, agent); body != "\x1ebatch\n8\n1\nns/a\nc8\n1\nns/b\nc" {
+		t.Errorf("bad body: %q", body)
+	}
+}
+
+func TestAsyncQueue(t *testing.T) {
+	for _, policy := range []FullPolicy{DropNewest, DropOldest, Block} {
+		started := make(chan struct{}, 10)
+		release := make(chan struct{})
+		sent := make(chan string, 10)
+		send := func(body []byte) error {
+			started <- struct{}{}
+			<-release
+			sent <- string(body)
+			return nil
+		}
+		q := newAsyncQueue(1, policy, 10*time.Millisecond, send, logger{})
+
+		q.put(bufOf("a"))
+		<-started // a 正在发送, 队列为空
+		if err := q.put(bufOf("b")); err != nil {
+			t.Errorf("policy %d: put error: %s", policy, err.Error())
+		}
+		err := q.put(bufOf("c"))
+		if policy == DropOldest {
+			if err != nil {
+				t.Errorf("policy %d: put error: %s", policy, err.Error())
+			}
+		} else if err == nil {
+			t.Errorf("policy %d: put on full queue should fail", policy)
+		}
+		if q.dropped.Load() != 1 {
+			t.Errorf("policy %d: bad dropped: %d", policy, q.dropped.Load())
+		}
+
+		close(release)
+		q.close()
+		close(sent)
+		var got []string
+		for s := range sent {
+			got = append(got, s)
+		}
+		want := "a,b"
+		if policy == DropOldest {
+			want = "a,c"
+		}
+		if strings.Join(got, ",") != want {
+			t.Errorf("policy %d: bad sent: %v", policy, got)
+		}
+
+		if err := q.put(bufOf("d")); err == nil {
+			t.Errorf("policy %d: put on closed queue should fail", policy)
+		}
+	}
+}
+
+// Block未设置timeout时使用默认值, 而不是立即丢弃
+func TestAsyncQueueBlockDefault(t *testing.T) {
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	send := func(body []byte) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	}
+	q := newAsyncQueue(1, Block, 0, send, logger{})
+	if q.timeout != DefaultBlockTimeout {
+		t.Errorf("bad timeout: %s", q.timeout)
+	}
+
+	q.put(bufOf("a"))
+	<-started
+	q.put(bufOf("b"))
+	time.AfterFunc(10*time.Millisecond, func() { close(release) })
+	if err := q.put(bufOf("c")); err != nil {
+		t.Errorf("put should block until sent: %s", err.Error())
+	}
+	q.close()
+}
+
+type panicTransport struct{}
+
+func (panicTransport) Send(body []byte) error { panic("boom") }
+func (panicTransport) Close() error           { return nil }
+
+// 后台goroutine调用Transport时panic, 不影响进程
+func TestTransportPanic(t *testing.T) {
+	opts := map[string]Option{
+		"sync":  WithNs("ns"),
+		"async": WithAsync(16, DropNewest, 0),
+		"batch": WithBatch(DefaultBatchMTU, time.Millisecond),
+		"aggr":  WithCounterAggregation(time.Millisecond),
+	}
+	for name, opt := range opts {
+		c, _ := NewClient(WithTransport(panicTransport{}), WithNs("ns"), WithLogger(NopLogger()), opt)
+		c.Counter("m")
+		c.Counter("m")
+		time.Sleep(10 * time.Millisecond)
+		c.Close(context.Background())
+
+		if st := c.Stats(); st.Panics == 0 || st.SendErrors != st.Panics || st.Sent != 0 {
+			t.Errorf("%s: bad stats: %+v", name, st)
+		}
+	}
+}
+
+func TestCounterAggregation(t *testing.T) {
+	var sent []string
+	send := func(body []byte) error {
+		sent = append(sent, string(body))
+		return nil
+	}
+	c := nsClient("ns")
+	a := newAggregator(counterAggregators, time.Hour, send, logger{})
+
+	for i := 0; i < 100; i++ {
+		a.add(pointOf(c.counterNBuilder("m", 2, map[string]string{"k": "v"})))
+	}
+	a.add(pointOf(c.counterNEBuilder("m", 1, map[string]string{"k": "v"})))
+	a.add(pointOf(c.counterNBuilder("m", 1, map[string]string{"k": "v2"})))
+	if a.accept(pointOf(c.gaugeBuilder("m", 1))) {
+		t.Errorf("gauge should not be aggregated")
+	}
+	a.close()
+
+	want := map[string]bool{
+		"200\nns/m\nk=v\nc": true,
+		"1\nns/m\nk=v\nce":  true,
+		"1\nns/m\nk=v2\nc":  true,
+	}
+	if len(sent) != len(want) {
+		t.Fatalf("bad sent: %q", sent)
+	}
+	for _, s := range sent {
+		if !want[s] {
+			t.Errorf("bad record: %q", s)
+		}
+	}
+}
+
+func TestRpcAggregation(t *testing.T) {
+	var sent []string
+	send := func(body []byte) error {
+		sent = append(sent, string(body))
+		return nil
+	}
+	c := nsClient("ns")
+	a := newAggregator(rpcAggregators, time.Hour, send, logger{})
+
+	a.add(pointOf(c.rpcMetricBuilder("rpc", "a", "b", 10*time.Millisecond, "ok", DefaultRpcVersion)))
+	a.add(pointOf(c.rpcMetricBuilder("rpc", "a", "b", 10*time.Millisecond, "ok", DefaultRpcVersion)))
+	a.add(pointOf(c.rpcMetricBuilder("rpc", "a", "b", 1000*time.Millisecond, "ok", DefaultRpcVersion)))
+	a.add(pointOf(c.rpcMetricBuilder("rpc", "a", "b", 5*time.Millisecond, "500", DefaultRpcVersion)))
+	if a.accept(pointOf(c.counterNBuilder("m", 1))) {
+		t.Errorf("counter should not be aggregated")
+	}
+	a.close()
+
+	if len(sent) != 2 {
+		t.Fatalf("bad sent: %q", sent)
+	}
+	want := map[string]bool{
+		"3,0,1020,10:2;1004:1,ok": true,
+		"1,1,5,5:1,500":           true,
+	}
+	for _, s := range sent {
+		lines := strings.Split(s, "\n")
+		if !want[lines[0]] || lines[1] != "ns/rpc" || lines[len(lines)-1] != "rpcs" {
+			t.Errorf("bad record: %q", s)
+		}
+	}
+}
+
+func TestLatencyBucket(t *testing.T) {
+	for _, ms := range []int64{0, 1, 127, 128, 1000, 123456, 1 << 40} {
+		b := latencyBucket(ms)
+		diff := b - ms
+		if diff < 0 {
+			diff = -diff
+		}
+		if float64(diff) > float64(ms)*0.01 {
+			t.Errorf("bucket of %d is %d, error too large", ms, b)
+		}
+	}
+}
+
+func TestCharPolicy(t *testing.T) {
+	tr := NewMemTransport()
+	c, _ := NewClient(WithTransport(tr), WithNs("a/b"))
+	defer c.Close(context.Background())
+
+	err := c.RpcMetric("rpc\n", "caller", "/api/user\nx=y", time.Millisecond, "o\nk", map[string]string{"k=1": "v=1"})
+	if err != nil {
+		t.Fatalf("lenient push error: %s", err.Error())
+	}
+	m, err := Decode(tr.Payloads()[0])
+	if err != nil {
+		t.Fatalf("decode error: %s", err.Error())
+	}
+	if m.Namespace != "a_b" || m.Metric != "rpc_" || m.Code != "o_k" {
+		t.Errorf("bad sanitize: %+v", m)
+	}
+	want := map[string]string{"caller": "caller", "callee": "/api/user_x_y", "k_1": "v_1"}
+	if !reflect.DeepEqual(m.Tags, want) {
+		t.Errorf("bad sanitized tags: %v", m.Tags)
+	}
+
+	strict, _ := NewClient(WithTransport(NewMemTransport()), WithNs("ns"), WithCharPolicy(CharStrict))
+	defer strict.Close(context.Background())
+	bads := []error{
+		strict.Counter("a\nb"),
+		strict.Counter("m", map[string]string{"k": "a=b"}),
+		strict.Counter("m", map[string]string{"k\r": "v"}),
+		strict.Rpc("caller", "callee\n", time.Millisecond, "ok"),
+	}
+	for i, err := range bads {
+		if !(err != nil && strings.Contains(err.Error(), "illegal char")) {
+			t.Errorf("case %d: strict policy should reject: %v", i, err)
+		}
+	}
+	if err := strict.Counter("m", map[string]string{"path": "/api/v1"}); err != nil {
+		t.Errorf("legal push error: %s", err.Error())
+	}
+}
+
+func bufOf(s string) *[]byte {
+	b := getBuf()
+	*b = append(*b, s...)
+	return b
+}
+
+func pointOf(mb *metricBuilder) *point {
+	p := mb.point()
+	return &p
+}
+
+// 不发送的Client, 只用来构造metric
+func nsClient(ns string) *Client {
+	c := &Client{}
+	c.SetNs(ns)
+	return c
+}
@@ -0,0 +1,178 @@
+package statsdlib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+/***************************************************************************
+ * rpc code 归一化: 把调用结果转成取值有限的code和明确的成功/失败,
+ * 避免把error的内容当作code上报(基数爆炸)
+ *   nil                                 "ok", 成功
+ *   string                              原样, "ok" "0" "200" "201" "203" 为成功
+ *   bool                                "ok"/"error"
+ *   整数(含 net/http 状态码)            十进制, 同string, 0 200 201 203 为成功
+ *   grpc codes.Code                     code名称, 如 "OK" "Unavailable", OK为成功
+ *   error                               失败, code依次取:
+ *     context.DeadlineExceeded          "timeout"
+ *     context.Canceled                  "canceled"
+ *     实现了 Code() string 的error       Code() 的返回值
+ *     grpc status error (GRPCStatus())  grpc code名称
+ *     其他                              "error"
+ *   其他类型(float、struct、指针等)     "unknown", 失败; 不用 %v 格式化, 避免基数爆炸
+ * string和整数使用同一个规则, 与agent的默认规则一致, 上报时不附加success, 见 point.appendValue
+ * 可以通过 WithCodeClassifier 替换
+ **************************************************************************/
+
+// 返回归一化后的code和是否成功
+type CodeClassifier func(code interface{}) (string, bool)
+
+// 取值 "ok" "0" "200" "201" "203" 为成功、其他均为失败, 与agent的默认规则一致
+var successCodes = map[string]bool{"ok": true, "0": true, "200": true, "201": true, "203": true}
+
+const (
+	CodeTimeout  = "timeout"
+	CodeCanceled = "canceled"
+	CodeError    = "error"
+	CodeUnknown  = "unknown" // 无法归一化的类型
+)
+
+/**
+ * @note
+ * 默认的code归一化规则, 自定义 CodeClassifier 可以用它处理不关心的类型
+ * @param interface{} $code 调用结果
+ *
+ * @return string, bool 归一化后的code, 是否成功
+ */
+func ClassifyCode(code interface{}) (string, bool) {
+	switch v := code.(type) {
+	case nil:
+		return "ok", true
+	case string:
+		return v, successCodes[v]
+	case bool:
+		if v {
+			return "ok", true
+		}
+		return CodeError, false
+	case error:
+		return classifyError(v), false
+	}
+
+	if n, ok := codeInt(code); ok {
+		return strconv.FormatInt(n, 10), intCodeSuccess(n)
+	}
+	rv := reflect.ValueOf(code)
+	if name, n, ok := grpcCode(rv); ok {
+		return name, n == 0
+	}
+
+	// 自定义的string/整数类型, 如 type Status string
+	switch rv.Kind() {
+	case reflect.String:
+		return rv.String(), successCodes[rv.String()]
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(rv.Int(), 10), intCodeSuccess(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatInt(int64(rv.Uint()), 10), intCodeSuccess(int64(rv.Uint()))
+	}
+	return CodeUnknown, false
+}
+
+func classifyError(err error) string {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return CodeTimeout
+	case errors.Is(err, context.Canceled):
+		return CodeCanceled
+	}
+
+	var coder interface{ Code() string }
+	if errors.As(err, &coder) {
+		return coder.Code()
+	}
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if name, _, ok := grpcStatusCode(e); ok {
+			return name
+		}
+	}
+	return CodeError
+}
+
+// 同 successCodes, 不格式化为string, 避免分配内存
+func intCodeSuccess(n int64) bool {
+	switch n {
+	case 0, 200, 201, 203:
+		return true
+	}
+	return false
+}
+
+func codeInt(code interface{}) (int64, bool) {
+	switch v := code.(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint:
+		return int64(v), true
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case uint64:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// google.golang.org/grpc/codes.Code, 不引入grpc的依赖
+func grpcCode(v reflect.Value) (string, uint64, bool) {
+	if !v.IsValid() || v.Kind() != reflect.Uint32 {
+		return "", 0, false
+	}
+	t := v.Type()
+	if t.PkgPath() != "google.golang.org/grpc/codes" || t.Name() != "Code" {
+		return "", 0, false
+	}
+	return codeName(v), v.Uint(), true
+}
+
+// 实现了 GRPCStatus() 的error, 取 status 的 Code()
+func grpcStatusCode(err error) (string, uint64, bool) {
+	method := reflect.ValueOf(err).MethodByName("GRPCStatus")
+	if !method.IsValid() || method.Type().NumIn() != 0 || method.Type().NumOut() != 1 {
+		return "", 0, false
+	}
+	status := method.Call(nil)[0]
+	if status.Kind() == reflect.Ptr && status.IsNil() {
+		return "OK", 0, true
+	}
+	code := status.MethodByName("Code")
+	if !code.IsValid() || code.Type().NumIn() != 0 || code.Type().NumOut() != 1 {
+		return "", 0, false
+	}
+	c := code.Call(nil)[0]
+	if c.Kind() != reflect.Uint32 {
+		return "", 0, false
+	}
+	return codeName(c), c.Uint(), true
+}
+
+func codeName(v reflect.Value) string {
+	if s, ok := v.Interface().(fmt.Stringer); ok {
+		return s.String()
+	}
+	return strconv.FormatUint(v.Uint(), 10)
+}
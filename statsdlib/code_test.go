@@ -0,0 +1,135 @@
+package statsdlib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type codedError struct{ code string }
+
+func (this codedError) Error() string { return "coded error: " + this.code }
+func (this codedError) Code() string  { return this.code }
+
+// 模拟 grpc 的 status error
+type fakeGrpcCode uint32
+
+func (this fakeGrpcCode) String() string {
+	if this == 0 {
+		return "OK"
+	}
+	return "Unavailable"
+}
+
+type fakeGrpcStatus struct{ code fakeGrpcCode }
+
+func (this *fakeGrpcStatus) Code() fakeGrpcCode { return this.code }
+
+type fakeGrpcError struct{ code fakeGrpcCode }
+
+func (this fakeGrpcError) Error() string               { return "rpc error: connection refused 10.0.0.1:8080" }
+func (this fakeGrpcError) GRPCStatus() *fakeGrpcStatus { return &fakeGrpcStatus{code: this.code} }
+
+type customStatus string
+
+type customErrno int
+
+func TestClassifyCode(t *testing.T) {
+	cases := []struct {
+		code    interface{}
+		want    string
+		success bool
+	}{
+		{nil, "ok", true},
+		{"ok", "ok", true},
+		{"200", "200", true},
+		{"rpcFunc.error", "rpcFunc.error", false},
+		{true, "ok", true},
+		{false, CodeError, false},
+		{0, "0", true},
+		{http.StatusOK, "200", true},
+		{http.StatusNoContent, "204", false},
+		{"204", "204", false},
+		{http.StatusFound, "302", false},
+		{http.StatusNotFound, "404", false},
+		{int32(500), "500", false},
+		{uint8(1), "1", false},
+		{context.DeadlineExceeded, CodeTimeout, false},
+		{fmt.Errorf("query user: %w", context.DeadlineExceeded), CodeTimeout, false},
+		{context.Canceled, CodeCanceled, false},
+		{fmt.Errorf("wrapped: %w", codedError{"E1001"}), "E1001", false},
+		{fakeGrpcError{code: 14}, "Unavailable", false},
+		{fmt.Errorf("call: %w", fakeGrpcError{code: 14}), "Unavailable", false},
+		{errors.New("dial tcp 10.0.0.1:80: connection refused"), CodeError, false},
+		{customStatus("ok"), "ok", true},
+		{customErrno(404), "404", false},
+		{1.5, CodeUnknown, false},
+		{struct{ ID int }{1}, CodeUnknown, false},
+		{&struct{}{}, CodeUnknown, false},
+	}
+	for _, cs := range cases {
+		code, success := ClassifyCode(cs.code)
+		if code != cs.want || success != cs.success {
+			t.Errorf("ClassifyCode(%#v) = %q, %v; want %q, %v", cs.code, code, success, cs.want, cs.success)
+		}
+	}
+}
+
+func TestRpcCodeWire(t *testing.T) {
+	tr := NewMemTransport()
+	c, _ := NewClient(WithTransport(tr), WithNs("ns"))
+	defer c.Close(context.Background())
+
+	c.RpcMetric("rpc", "a", "b", time.Millisecond, "ok")
+	c.RpcMetric("rpc", "a", "b", time.Millisecond, http.StatusNoContent)
+	c.RpcMetric("rpc", "a", "b", time.Millisecond, codedError{"ok"})
+	c.RpcMetric("rpc", "a", "b", time.Millisecond, context.DeadlineExceeded)
+	c.RpcMetric("rpc", "a", "b", time.Millisecond, "a,b")
+
+	// 与agent默认规则一致时不附加success
+	want := []string{"1,ok", "1,204", "1,ok,false", "1,timeout", "1,a_b"}
+	payloads := tr.Payloads()
+	if len(payloads) != len(want) {
+		t.Fatalf("bad payloads: %q", payloads)
+	}
+	for i, w := range want {
+		m, err := Decode(payloads[i])
+		if err != nil || m.Value != w {
+			t.Errorf("payload %d: got %q, want value %q", i, payloads[i], w)
+		}
+	}
+	if m, _ := Decode(payloads[2]); m.Errors != 1 || m.Code != "ok" {
+		t.Errorf("bad decode of explicit failure: %+v", m)
+	}
+}
+
+func TestCodeClassifier(t *testing.T) {
+	tr := NewMemTransport()
+	classifier := func(code interface{}) (string, bool) {
+		if n, ok := code.(int); ok && n == 404 {
+			return "not_found", true
+		}
+		return ClassifyCode(code)
+	}
+	c, _ := NewClient(WithTransport(tr), WithNs("ns"), WithCodeClassifier(classifier), WithRpcAggregation(time.Hour))
+
+	c.RpcMetric("rpc", "a", "b", time.Millisecond, 404)
+	c.RpcMetric("rpc", "a", "b", time.Millisecond, 404)
+	c.NewRpc("rpc", "a", "b").Observe(time.Millisecond, 500)
+	c.Close(context.Background())
+
+	got := map[string]Metric{}
+	for _, body := range tr.Payloads() {
+		m, _ := Decode(body)
+		got[m.Code] = m
+	}
+	if m := got["not_found"]; m.Count != 2 || m.Errors != 0 {
+		t.Errorf("bad not_found summary: %+v", m)
+	}
+	if m := got["500"]; m.Count != 1 || m.Errors != 1 {
+		t.Errorf("bad 500 summary: %+v", m)
+	}
+}
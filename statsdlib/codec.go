@@ -0,0 +1,247 @@
+package statsdlib
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/***************************************************************************
+ * 协议解析: Build() 的逆过程, 用于编写agent、抓包工具和测试断言
+ * 单条记录格式:
+ *   <value>\n<ns>/<metric>\n<tagk>=<tagv>\n...\n<aggregator>
+ * 批量格式见 batch.go
+ **************************************************************************/
+
+// 解析后的一条metric
+type Metric struct {
+	Namespace  string            `json:"ns"`
+	Metric     string            `json:"metric"`
+	Tags       map[string]string `json:"tags"`
+	Aggregator string            `json:"aggregator"`
+	Value      string            `json:"value"` // 原始value
+
+	// 按aggregator解析后的value, 与aggregator无关的字段为零值
+	Count        int64           `json:"count"`          // c/ce 计数; rt 计数(未指定时为1); rpc/rpce 为1; rpcs/rpces 调用次数
+	Float        float64         `json:"float"`          // g/percentile 的值
+	Code         string          `json:"code"`           // rt/rpc/rpce/rpcs/rpces 的code
+	LatencyMs    int64           `json:"latency_ms"`     // rpc/rpce 耗时
+	Errors       int64           `json:"errors"`         // rpc/rpce 失败时为1; rpcs/rpces 失败次数
+	LatencySumMs int64           `json:"latency_sum_ms"` // rpcs/rpces 耗时总和
+	Latencies    map[int64]int64 `json:"latencies"`      // rpcs/rpces 耗时分布, ms => 次数
+	Percentiles  []string        `json:"percentiles"`    // percentile 的分位值列表
+}
+
+/**
+ * @note
+ * 解析一条记录
+ * @param []byte $data Build() 的结果
+ *
+ * @return Metric, error
+ */
+func Decode(data []byte) (Metric, error) {
+	m := Metric{}
+
+	lines := strings.Split(string(data), "\n")
+	if len(lines) < 3 {
+		return m, fmt.Errorf("decode: too few lines: %d", len(lines))
+	}
+
+	// ns/metric
+	ns, metric, found := strings.Cut(lines[1], "/")
+	if !found {
+		return m, fmt.Errorf("decode: missing '/' in %q", lines[1])
+	}
+	if metric == "" {
+		return m, fmt.Errorf("decode: empty metric")
+	}
+	m.Namespace = ns
+	m.Metric = metric
+
+	// tags
+	for _, line := range lines[2 : len(lines)-1] {
+		k, v, found := strings.Cut(line, "=")
+		if !found {
+			return m, fmt.Errorf("decode: bad tag %q", line)
+		}
+		if k == "" {
+			return m, fmt.Errorf("decode: empty tagk in %q", line)
+		}
+		if m.Tags == nil {
+			m.Tags = map[string]string{}
+		}
+		if _, dup := m.Tags[k]; dup {
+			return m, fmt.Errorf("decode: duplicate tagk %q", k)
+		}
+		m.Tags[k] = v
+	}
+
+	// aggregator & value
+	m.Aggregator = lines[len(lines)-1]
+	m.Value = lines[0]
+	err := m.parseValue()
+	if err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+/**
+ * @note
+ * 解析一个udp包/一帧, 兼容批量格式和单条格式
+ * @param []byte $data
+ *
+ * @return []Metric, error
+ */
+func DecodeBatch(data []byte) ([]Metric, error) {
+	if !bytes.HasPrefix(data, []byte(batchHeader)) {
+		m, err := Decode(data)
+		if err != nil {
+			return nil, err
+		}
+		return []Metric{m}, nil
+	}
+
+	metrics := []Metric{}
+	rest := data[len(batchHeader):]
+	for len(rest) > 0 {
+		pos := bytes.IndexByte(rest, '\n')
+		if pos < 0 {
+			return metrics, fmt.Errorf("decode: missing record length")
+		}
+		size, err := strconv.Atoi(string(rest[:pos]))
+		if err != nil || size < 0 {
+			return metrics, fmt.Errorf("decode: bad record length %q", rest[:pos])
+		}
+		rest = rest[pos+1:]
+		if size > len(rest) {
+			return metrics, fmt.Errorf("decode: record length %d exceeds datagram", size)
+		}
+
+		m, err := Decode(rest[:size])
+		if err != nil {
+			return metrics, err
+		}
+		metrics = append(metrics, m)
+		rest = rest[size:]
+	}
+	return metrics, nil
+}
+
+/**
+ * @note
+ * 编码一条metric, 与 Build() 的结果一致
+ * @param Metric $m
+ *
+ * @return []byte
+ */
+func Encode(m Metric) []byte {
+	mb := metricBuilder{}.Name(m.Metric).Ns(m.Namespace).AddTags(m.Tags).Agg(m.Value, m.Aggregator)
+	return []byte(mb.Build())
+}
+
+func (this *Metric) parseValue() error {
+	var err error
+	value := this.Value
+
+	switch this.Aggregator {
+	case "c", "ce":
+		this.Count, err = strconv.ParseInt(value, 10, 64)
+	case "g":
+		this.Float, err = strconv.ParseFloat(value, 64)
+	case "rt":
+		this.Count = 1
+		this.Code = value
+		// 带计数时为 <cnt>,<code>
+		if cnt, code, found := strings.Cut(value, ","); found {
+			if n, err2 := strconv.ParseInt(cnt, 10, 64); err2 == nil {
+				this.Count = n
+				this.Code = code
+			}
+		}
+	case "rpc", "rpce":
+		this.Count = 1
+		var fail bool
+		this.LatencyMs, this.Code, fail, err = splitRpcValue(value)
+		if fail {
+			this.Errors = 1
+		}
+	case "rpc" + rpcSummarySuffix, "rpce" + rpcSummarySuffix:
+		err = this.parseRpcSummary()
+	default:
+		if !isPercentiles(this.Aggregator) {
+			return fmt.Errorf("decode: unknown aggregator %q", this.Aggregator)
+		}
+		this.Percentiles = strings.Split(this.Aggregator, ",")
+		this.Float, err = strconv.ParseFloat(value, 64)
+	}
+
+	if err != nil {
+		return fmt.Errorf("decode: bad value %q for aggregator %s: %s", value, this.Aggregator, err.Error())
+	}
+	return nil
+}
+
+// <count>,<errors>,<latency_sum_ms>,<ms>:<n>;<ms>:<n>...,<code>
+func (this *Metric) parseRpcSummary() error {
+	parts := strings.SplitN(this.Value, ",", 5)
+	if len(parts) != 5 {
+		return fmt.Errorf("expect 5 fields")
+	}
+
+	var err error
+	nums := []*int64{&this.Count, &this.Errors, &this.LatencySumMs}
+	for i, num := range nums {
+		*num, err = strconv.ParseInt(parts[i], 10, 64)
+		if err != nil {
+			return err
+		}
+	}
+
+	this.Latencies = map[int64]int64{}
+	if parts[3] != "" {
+		for _, item := range strings.Split(parts[3], ";") {
+			ms, n, found := strings.Cut(item, ":")
+			if !found {
+				return fmt.Errorf("bad latency %q", item)
+			}
+			msv, err := strconv.ParseInt(ms, 10, 64)
+			if err != nil {
+				return err
+			}
+			nv, err := strconv.ParseInt(n, 10, 64)
+			if err != nil {
+				return err
+			}
+			this.Latencies[msv] += nv
+		}
+	}
+	this.Code = parts[4]
+	return nil
+}
+
+// 分位值列表, 形如 p99,p75,p99.9
+func isPercentiles(aggregator string) bool {
+	if aggregator == "" {
+		return false
+	}
+	for _, p := range strings.Split(aggregator, ",") {
+		if len(p) < 2 || p[0] != 'p' {
+			return false
+		}
+		dots := 0
+		for i := 1; i < len(p); i++ {
+			switch {
+			case p[i] == '.' && i > 1 && i < len(p)-1:
+				dots++
+			case p[i] < '0' || p[i] > '9':
+				return false
+			}
+		}
+		if dots > 1 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,168 @@
+package statsdlib
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDecode(t *testing.T) {
+	c := nsClient("ns")
+	tags := map[string]string{"k": "v"}
+
+	cases := []struct {
+		mb   *metricBuilder
+		want Metric
+	}{
+		{c.counterNBuilder("m", 3, tags), Metric{Count: 3}},
+		{c.counterNEBuilder("m", 2), Metric{Count: 2}},
+		{c.gaugeBuilder("m", 1.5), Metric{Float: 1.5}},
+		{c.ratioBuilder("m", "ok"), Metric{Count: 1, Code: "ok"}},
+		{c.ratioBuilder("m", "500", 7), Metric{Count: 7, Code: "500"}},
+		{c.percentileBuilder("m", 88, []string{"p99", "p99.9"}, tags), Metric{Float: 88, Percentiles: []string{"p99", "p99.9"}}},
+		{c.rpcMetricBuilder("rpc", "a", "b", 12*time.Millisecond, 200, DefaultRpcVersion), Metric{Count: 1, LatencyMs: 12, Code: "200"}},
+		{c.rpcMetricBuilder("rpc", "a", "b", 12*time.Millisecond, "x", EnhanceRpcVersion), Metric{Count: 1, LatencyMs: 12, Code: "x", Errors: 1}},
+		{c.rpcMetricBuilder("rpc", "a", "b", 12*time.Millisecond, 204, DefaultRpcVersion), Metric{Count: 1, LatencyMs: 12, Code: "204", Errors: 1}},
+		{c.rpcMetricBuilder("rpc", "a", "b", 12*time.Millisecond, codedError{"ok"}, DefaultRpcVersion), Metric{Count: 1, LatencyMs: 12, Code: "ok", Errors: 1}},
+	}
+	for _, cs := range cases {
+		m, err := Decode([]byte(cs.mb.Build()))
+		if err != nil {
+			t.Errorf("decode %q error: %s", cs.mb.Build(), err.Error())
+			continue
+		}
+		want := cs.want
+		want.Namespace, want.Metric, want.Aggregator, want.Value = cs.mb.Namespace, cs.mb.Metric, cs.mb.Aggregator, cs.mb.Value
+		want.Tags = cs.mb.Tags
+		if !reflect.DeepEqual(m, want) {
+			t.Errorf("bad decode of %q: %+v", cs.mb.Build(), m)
+		}
+	}
+
+	// rpc 汇总
+	var sent []byte
+	a := newAggregator(rpcAggregators, time.Hour, func(body []byte) error { sent = body; return nil }, logger{})
+	a.add(pointOf(c.rpcMetricBuilder("rpc", "a", "b", 10*time.Millisecond, "500", DefaultRpcVersion)))
+	a.add(pointOf(c.rpcMetricBuilder("rpc", "a", "b", 10*time.Millisecond, "500", DefaultRpcVersion)))
+	a.close()
+	m, err := Decode(sent)
+	if err != nil {
+		t.Fatalf("decode rpcs error: %s", err.Error())
+	}
+	if m.Aggregator != "rpcs" || m.Count != 2 || m.Errors != 2 || m.LatencySumMs != 20 || m.Code != "500" || !reflect.DeepEqual(m.Latencies, map[int64]int64{10: 2}) {
+		t.Errorf("bad decode of rpcs: %+v", m)
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	bads := []string{
+		"",
+		"1\nns/m",
+		"1\nnsm\nc",
+		"1\nns/\nc",
+		"1\nns/m\nk\nc",
+		"1\nns/m\n=v\nc",
+		"1\nns/m\nk=v\nk=v2\nc",
+		"x\nns/m\nc",
+		"x\nns/m\ng",
+		"1\nns/m\nfoo",
+		"1\nns/m\np99,",
+		"10\nns/m\nrpc",
+		"1,0,1,10,ok\nns/m\nrpcs",
+		"1,0,1,10:x,ok\nns/m\nrpcs",
+	}
+	for _, bad := range bads {
+		if _, err := Decode([]byte(bad)); err == nil {
+			t.Errorf("decode %q should fail", bad)
+		}
+	}
+}
+
+func TestDecodeBatch(t *testing.T) {
+	var sent [][]byte
+	send := func(body []byte) error {
+		sent = append(sent, append([]byte(nil), body...))
+		return nil
+	}
+	b := newBatcher(DefaultBatchMTU, time.Hour, send, logger{})
+	b.add([]byte("1\nns/a\nc"))
+	b.add([]byte("2.000000\nns/b\nk=v\ng"))
+	b.close()
+
+	ms, err := DecodeBatch(sent[0])
+	if err != nil {
+		t.Fatalf("decode batch error: %s", err.Error())
+	}
+	if len(ms) != 2 || ms[0].Metric != "a" || ms[1].Float != 2 || ms[1].Tags["k"] != "v" {
+		t.Errorf("bad batch: %+v", ms)
+	}
+
+	ms, err = DecodeBatch([]byte("1\nns/a\nc"))
+	if err != nil || len(ms) != 1 {
+		t.Errorf("bad single: %+v, %v", ms, err)
+	}
+	// 单条记录的value与打包头相似
+	tr := NewMemTransport()
+	c, _ := NewClient(WithTransport(tr), WithNs("ns"))
+	c.Ratio("m", "#batch")
+	c.Close(context.Background())
+	ms, err = DecodeBatch(tr.Payloads()[0])
+	if err != nil || len(ms) != 1 || ms[0].Code != "#batch" {
+		t.Errorf("bad single: %+v, %v", ms, err)
+	}
+	for _, bad := range []string{"\x1ebatch\n8", "\x1ebatch\nx\n", "\x1ebatch\n100\n1\nns/a\nc"} {
+		if _, err := DecodeBatch([]byte(bad)); err == nil {
+			t.Errorf("decode batch %q should fail", bad)
+		}
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	f.Add([]byte("1\nns/m\nk=v\nc"))
+	f.Add([]byte("1.500000\nns/m\ng"))
+	f.Add([]byte("3,ok\nns/m\nrt"))
+	f.Add([]byte("88.000000\nns/m\np99,p75"))
+	f.Add([]byte("12,200\nns/rpc\ncaller=a\ncallee=b\nrpc"))
+	f.Add([]byte("2,1,20,10:2,500\nns/rpc\ncaller=a\ncallee=b\nrpcs"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := Decode(data)
+		if err != nil {
+			return
+		}
+		m2, err := Decode(Encode(m))
+		if err != nil {
+			t.Fatalf("decode of encoded %+v error: %s", m, err.Error())
+		}
+		if math.IsNaN(m.Float) && math.IsNaN(m2.Float) {
+			m.Float, m2.Float = 0, 0
+		}
+		if !reflect.DeepEqual(m, m2) {
+			t.Fatalf("round trip mismatch: %+v != %+v", m, m2)
+		}
+	})
+}
+
+func TestSortedTags(t *testing.T) {
+	c := nsClient("ns")
+	tags := map[string]string{}
+	for _, k := range []string{"z", "a", "m", "b", "y", "c"} {
+		tags[k] = "v" + k
+	}
+	want := "1\nns/m\na=va\nb=vb\nc=vc\nm=vm\ny=vy\nz=vz\nc"
+	for i := 0; i < 20; i++ {
+		if body := c.counterNBuilder("m", 1, tags).Build(); body != want {
+			t.Fatalf("unsorted tags: %q", body)
+		}
+	}
+
+	k1 := NewSeriesKey("ns", "m", map[string]string{"a": "1", "b": "2"})
+	k2 := NewSeriesKey("ns", "m", map[string]string{"b": "2", "a": "1"})
+	if k1 != k2 || k1.String() != "ns/m\na=1\nb=2" {
+		t.Errorf("bad series key: %q, %q", k1, k2)
+	}
+	if NewSeriesKey("ns", "m", nil) != "ns/m" {
+		t.Errorf("bad series key without tags")
+	}
+}
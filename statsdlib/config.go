@@ -2,113 +2,237 @@ package statsdlib
 
 import (
 	"fmt"
-	"io/ioutil"
-	"net"
+	"io"
+	"os"
+	"path/filepath"
 	"strings"
-	"syscall"
+	"time"
 )
 
-// statsd server
-var _statsdServer *statsdServer = &statsdServer{Addr: "127.0.0.1:788"}
-
-type statsdServer struct {
-	Addr    string       `json:"addr"`
-	UdpAddr *net.UDPAddr `json:"udp_addr"`
+// Init 的配置
+type Config struct {
+	Addr           string         `json:"addr"`         // metrics-agent地址, 默认 127.0.0.1:788, 见 NewTransport
+	Ns             string         `json:"ns"`           // namespace, 为空时使用 cluster.service_name
+	ServiceName    string         `json:"service_name"` // 服务名
+	Module         string         `json:"module"`       // 模块名
+	Cluster        string         `json:"cluster"`      // 集群名
+	Limits         Limits         `json:"limits"`       // 长度/个数限制, 默认 DefaultLimits
+	CharPolicy     CharPolicy     `json:"char_policy"`  // 非法字符的处理方式, 默认 CharLenient
+	LimitPolicy    LimitPolicy    `json:"limit_policy"` // 超出限制时的处理方式, 默认 LimitReject
+	Logger         Logger         `json:"-"`            // 日志输出, 默认不输出, 见 NewSlogLogger
+	LogWriter      io.Writer      `json:"-"`            // 按行输出文本日志, Logger 不为空时忽略
+	LogLevel       LogLevel       `json:"log_level"`    // 日志级别, 默认 LogInfo
+	CodeClassifier CodeClassifier `json:"-"`            // rpc code的归一化规则, 默认 ClassifyCode
+	Transport      Transport      `json:"-"`            // 自定义发送方式, 设置后忽略Addr
+
+	// 相同的Warn/Error日志的限频间隔, 见 WithLogRepeatInterval
+	LogRepeatInterval time.Duration `json:"log_repeat_interval"`
+	// 自身统计的上报间隔, >0 时开启, 见 WithSelfStats
+	SelfStatsInterval time.Duration `json:"self_stats_interval"`
+
+	// 批量发送, BatchMTU>0 时开启, 见 WithBatch
+	BatchMTU      int           `json:"batch_mtu"`
+	BatchInterval time.Duration `json:"batch_interval"`
+
+	// 异步发送, AsyncQueueSize>0 时开启, 见 WithAsync
+	AsyncQueueSize    int           `json:"async_queue_size"`
+	AsyncFullPolicy   FullPolicy    `json:"async_full_policy"`
+	AsyncBlockTimeout time.Duration `json:"async_block_timeout"` // Block策略的等待时间, 默认 DefaultBlockTimeout
+
+	// c/ce计数预聚合, CounterAggInterval>0 时开启, 见 WithCounterAggregation
+	CounterAggInterval time.Duration `json:"counter_agg_interval"`
+	// rpc/rpce预聚合, RpcAggInterval>0 时开启, 见 WithRpcAggregation
+	RpcAggInterval time.Duration `json:"rpc_agg_interval"`
+
+	// 所有metric都带上的默认tags, 见 SetDefaultTags
+	DefaultTags map[string]string `json:"default_tags"`
+	// 把 host 和非空的 service_name/module/cluster 加入默认tags, DefaultTags 中的同名key优先
+	MetaTags bool `json:"meta_tags"`
+
+	// 从 WorkDir 读取 .statsd/statsd.cfg.txt 和 .deploy/*.txt (旧版行为),
+	// 显式设置的字段优先于文件中的值
+	LoadFiles bool `json:"load_files"`
+	// 日志写到 WorkDir/.statsd/statsd.log, Logger/LogWriter 不为空时忽略
+	LogFile bool `json:"log_file"`
+	// 日志文件的切分和清理, 零值时使用 DefaultLogRotate
+	LogRotate LogRotate `json:"log_rotate"`
+	// 配置文件和日志所在的目录, 默认为进程工作目录
+	WorkDir string `json:"work_dir"`
+
+	// .deploy 读取失败时只记日志, 仅用于自动初始化
+	ignoreMetaErr bool
 }
 
-func (this statsdServer) Init() error {
-	wd, _ := syscall.Getwd()
+// 旧版行为: 读取工作目录下的配置文件; 日志文件需要通过环境变量开启, 见 autoInit
+var legacyConfig = Config{LoadFiles: true, ignoreMetaErr: true}
 
-	statsdServerAddrFile := wd + "/.statsd/statsd.cfg.txt"
-	c, err := _read(statsdServerAddrFile)
-	if err != nil {
-		logger{}.Info("use default metrics-agent addr: %s", _statsdServer.Addr)
-	} else {
-		logger{}.Info("use metrics-agent addr: %s", c)
-		_statsdServer.Addr = c
-	}
+// service meta
+type serviceMeta struct {
+	ServiceName string `json:"service_name"`
+	Module      string `json:"module"`
+	Cluster     string `json:"cluster"`
+}
 
-	addr, err := net.ResolveUDPAddr("udp4", _statsdServer.Addr)
-	if err != nil {
-		return err
+func (this Config) workDir() string {
+	if this.WorkDir != "" {
+		return this.WorkDir
 	}
-	_statsdServer.UdpAddr = addr
-	return nil
+	wd, _ := os.Getwd()
+	return wd
 }
 
-// statsd client
-var _statsdClient *statsdClient = &statsdClient{}
-
-type statsdClient struct {
-	UdpAddr *net.UDPAddr `json:"udp_addr"`
-	UdpConn *net.UDPConn `json:"udp_conn"`
+func (this Config) meta() serviceMeta {
+	return serviceMeta{ServiceName: this.ServiceName, Module: this.Module, Cluster: this.Cluster}
 }
 
-func (this statsdClient) Init() error {
-	var (
-		err error = nil
-	)
-
-	_statsdClient.UdpAddr, err = net.ResolveUDPAddr("udp4", ":0")
-	if err != nil {
-		return fmt.Errorf("open udp connection error, [err:%s]", err.Error())
+// 根据配置创建Client, 需要读的文件读失败时返回错误
+func (this Config) newClient() (*Client, error) {
+	cfg := this
+
+	lg := logger{l: cfg.Logger, level: cfg.LogLevel}
+	var logFile *FileLogger
+	switch {
+	case lg.l != nil: // Logger 优先
+	case cfg.LogWriter != nil:
+		lg.l = NewWriterLogger(cfg.LogWriter)
+	case cfg.LogFile:
+		var err error
+		rotate := cfg.LogRotate
+		if rotate == (LogRotate{}) {
+			rotate = DefaultLogRotate
+		}
+		logFile, err = NewFileLogger(legacyLogFile(cfg.workDir()), rotate)
+		if err != nil {
+			return nil, fmt.Errorf("open log file error, [err:%s]", err.Error())
+		}
+		lg.l = logFile
 	}
-
-	_statsdClient.UdpConn, err = net.ListenUDP("udp4", _statsdClient.UdpAddr)
+	c, err := cfg.newClientWithLogger(lg)
 	if err != nil {
-		return fmt.Errorf("open udp connection error, [err:%s]", err.Error())
+		if logFile != nil {
+			logFile.Close()
+		}
+		return nil, err
 	}
-
-	logger{}.Info("metric open udp on %s\n", _statsdClient.UdpAddr.String())
-	return nil
+	if logFile != nil {
+		c.logFile = logFile
+	}
+	return c, nil
 }
 
-// service meta
-var _serviceMeta *serviceMeta = &serviceMeta{}
-
-type serviceMeta struct {
-	ServiceName string `json:"service_name"`
-	Module      string `json:"module"`
-	Cluster     string `json:"cluster"`
-	Ns          string `json:"ns"`
-}
+func (this Config) newClientWithLogger(lg logger) (*Client, error) {
+	cfg := this
+	if cfg.LoadFiles {
+		err := cfg.loadFiles(lg)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-func (this serviceMeta) Init() error {
-	wd, _ := syscall.Getwd()
+	if cfg.Ns == "" && cfg.Cluster != "" && cfg.ServiceName != "" {
+		cfg.Ns = cfg.Cluster + "." + cfg.ServiceName
+	}
 
-	// read metas
-	deployMetaPath := wd + "/.deploy/"
-	serviceNameFile := deployMetaPath + "service.service_name.txt"
-	moduleFile := deployMetaPath + "service.module.txt"
-	clusterFile := deployMetaPath + "service.cluster.txt"
+	opts := []Option{WithNs(cfg.Ns), WithLogger(lg.l), WithLogLevel(lg.level), WithLogRepeatInterval(cfg.LogRepeatInterval), WithCharPolicy(cfg.CharPolicy), WithLimitPolicy(cfg.LimitPolicy), WithCodeClassifier(cfg.CodeClassifier)}
+	if cfg.Addr != "" {
+		opts = append(opts, WithAddr(cfg.Addr))
+	}
+	if cfg.Transport != nil {
+		opts = append(opts, WithTransport(cfg.Transport))
+	}
+	if cfg.Limits != (Limits{}) {
+		opts = append(opts, WithLimits(cfg.Limits))
+	}
+	if cfg.BatchMTU > 0 {
+		opts = append(opts, WithBatch(cfg.BatchMTU, cfg.BatchInterval))
+	}
+	if cfg.AsyncQueueSize > 0 {
+		opts = append(opts, WithAsync(cfg.AsyncQueueSize, cfg.AsyncFullPolicy, cfg.AsyncBlockTimeout))
+	}
+	if cfg.CounterAggInterval > 0 {
+		opts = append(opts, WithCounterAggregation(cfg.CounterAggInterval))
+	}
+	if cfg.RpcAggInterval > 0 {
+		opts = append(opts, WithRpcAggregation(cfg.RpcAggInterval))
+	}
+	if cfg.SelfStatsInterval > 0 {
+		opts = append(opts, WithSelfStats(cfg.SelfStatsInterval))
+	}
+	if tags := cfg.defaultTags(); tags != nil {
+		opts = append(opts, WithDefaultTags(tags))
+	}
+	return NewClient(opts...)
+}
 
-	c, err := _read(serviceNameFile)
-	if err != nil {
-		return err
+// DefaultTags 加上 MetaTags 对应的tags
+func (this Config) defaultTags() map[string]string {
+	if !this.MetaTags {
+		return this.DefaultTags
 	}
-	_serviceMeta.ServiceName = c
 
-	c, err = _read(moduleFile)
-	if err != nil {
-		return err
+	tags := map[string]string{}
+	host, _ := os.Hostname()
+	meta := this.meta()
+	for k, v := range map[string]string{"host": host, "service_name": meta.ServiceName, "module": meta.Module, "cluster": meta.Cluster} {
+		if v != "" {
+			tags[k] = v
+		}
 	}
-	_serviceMeta.Module = c
+	for k, v := range this.DefaultTags {
+		tags[k] = v
+	}
+	return tags
+}
 
-	c, err = _read(clusterFile)
-	if err != nil {
-		return err
+// 读取 .statsd/statsd.cfg.txt 和 .deploy/*.txt, 只填充未显式设置的字段
+func (this *Config) loadFiles(lg logger) error {
+	wd := this.workDir()
+
+	// statsd server, 配置文件不存在时使用默认地址
+	if this.Addr == "" {
+		c, err := _read(filepath.Join(wd, ".statsd", "statsd.cfg.txt"))
+		if err != nil {
+			lg.Info("use default metrics-agent addr", "addr", defaultAddr)
+		} else {
+			lg.Info("use metrics-agent addr", "addr", c)
+			this.Addr = c
+		}
 	}
-	_serviceMeta.Cluster = c
 
-	_serviceMeta.Ns = _serviceMeta.Cluster + "." + _serviceMeta.ServiceName
+	// service meta, 已经显式设置了ns时可以缺失
+	deployMetaPath := filepath.Join(wd, ".deploy")
+	metas := []struct {
+		file  string
+		value *string
+	}{
+		{"service.service_name.txt", &this.ServiceName},
+		{"service.module.txt", &this.Module},
+		{"service.cluster.txt", &this.Cluster},
+	}
+	for _, m := range metas {
+		if *m.value != "" {
+			continue
+		}
+		c, err := _read(filepath.Join(deployMetaPath, m.file))
+		if err != nil {
+			if this.Ns != "" {
+				continue
+			}
+			if this.ignoreMetaErr {
+				lg.Erro("service meta init error", "err", err)
+				return nil
+			}
+			return fmt.Errorf("service meta init error: %s", err.Error())
+		}
+		*m.value = c
+	}
 
-	logger{}.Info("use service meta config: \nservice_name:%s\nmoduel:%s\ncluster:%s",
-		_serviceMeta.ServiceName, _serviceMeta.Module, _serviceMeta.Cluster)
+	lg.Info("use service meta config", "service_name", this.ServiceName, "module", this.Module, "cluster", this.Cluster)
 	return nil
 }
 
 func _read(filename string) (string, error) {
-	content, err := ioutil.ReadFile(filename)
+	content, err := os.ReadFile(filename)
 	if err != nil {
 		return "", fmt.Errorf("read file error, [file:%s][err:%s]", filename, err.Error())
 	}
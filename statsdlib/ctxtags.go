@@ -0,0 +1,142 @@
+package statsdlib
+
+import (
+	"context"
+	"time"
+)
+
+/***************************************************************************
+ * context中的tags: 请求级别的tag(租户、路由、灰度标记等)放在context里,
+ * 通过 XxxCtx 接口上报时自动合并:
+ *   ctx = statsd.WithTags(ctx, "tenant", "t1")
+ *   statsd.CounterCtx(ctx, "api.hit", map[string]string{"api": "login"})
+ * 同名key的优先级: 显式传入的tags > rpc的caller/callee > context中的tags,
+ * context中后设置的覆盖先设置的
+ * 合并后的tag个数同样受 Limits.MaxTagCnt 限制, 超出时按LimitPolicy处理,
+ * 需要丢弃时先丢弃context中的tags
+ **************************************************************************/
+
+type ctxTagsKey struct{}
+
+/**
+ * @note
+ * 在context中添加一个tag
+ * @param context $ctx
+ * @param string  $k   tag key
+ * @param string  $v   tag value
+ *
+ * @return context.Context
+ */
+func WithTags(ctx context.Context, k string, v string) context.Context {
+	return WithTagMap(ctx, map[string]string{k: v})
+}
+
+// 在context中添加多个tag
+func WithTagMap(ctx context.Context, tags map[string]string) context.Context {
+	parent := ctxTags(ctx)
+	merged := make(map[string]string, len(parent)+len(tags))
+	for k, v := range parent {
+		merged[k] = v
+	}
+	for k, v := range tags {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, ctxTagsKey{}, merged)
+}
+
+// context中的tags, 返回拷贝
+func TagsFromContext(ctx context.Context) map[string]string {
+	parent := ctxTags(ctx)
+	if parent == nil {
+		return nil
+	}
+	tags := make(map[string]string, len(parent))
+	for k, v := range parent {
+		tags[k] = v
+	}
+	return tags
+}
+
+// 只读, 不分配内存
+func ctxTags(ctx context.Context) map[string]string {
+	if ctx == nil {
+		return nil
+	}
+	tags, _ := ctx.Value(ctxTagsKey{}).(map[string]string)
+	return tags
+}
+
+/**
+ * @note
+ * 同 RpcMetric, 合并context中的tags
+ * @param context  $ctx
+ * @param string   $metric  指标名
+ * @param string   $caller  主调服务标识
+ * @param string   $callee  被掉服务标识
+ * @param duration $latency 调用耗时
+ * @param any      $code    调用结果, 归一化规则见 ClassifyCode
+ * @param map      $tags    可选的tag, 优先于context中的tags
+ *
+ * @return error
+ */
+func RpcMetricCtx(ctx context.Context, metric string, caller string, callee string, latency time.Duration, code interface{}, tags ...map[string]string) error {
+	return defaultClient().RpcMetricCtx(ctx, metric, caller, callee, latency, code, tags...)
+}
+
+// 同 RpcMetricE, 合并context中的tags
+func RpcMetricECtx(ctx context.Context, metric string, caller string, callee string, latency time.Duration, code interface{}, tags ...map[string]string) error {
+	return defaultClient().RpcMetricECtx(ctx, metric, caller, callee, latency, code, tags...)
+}
+
+/**
+ * @note
+ * 同 Counter, 合并context中的tags
+ * @param context $ctx
+ * @param string  $metric 计数指标名称
+ * @param map     $tags   可选的tag, 优先于context中的tags
+ *
+ * @return error
+ */
+func CounterCtx(ctx context.Context, metric string, tags ...map[string]string) error {
+	return CounterNCtx(ctx, metric, 1, tags...)
+}
+func CounterNCtx(ctx context.Context, metric string, cnt int, tags ...map[string]string) error {
+	return defaultClient().CounterNCtx(ctx, metric, cnt, tags...)
+}
+
+// 同 Gauge, 合并context中的tags
+func GaugeCtx(ctx context.Context, metric string, value float64, tags ...map[string]string) error {
+	return defaultClient().GaugeCtx(ctx, metric, value, tags...)
+}
+
+func (this *Client) RpcMetricCtx(ctx context.Context, metric string, caller string, callee string, latency time.Duration, code interface{}, tags ...map[string]string) error {
+	cfg := this.config()
+	p := this.rpcPoint(cfg, metric, caller, callee, latency, code, DefaultRpcVersion, tags)
+	p.ctxTags = ctxTags(ctx)
+	return this.pushPoint(cfg, &p)
+}
+
+func (this *Client) RpcMetricECtx(ctx context.Context, metric string, caller string, callee string, latency time.Duration, code interface{}, tags ...map[string]string) error {
+	cfg := this.config()
+	p := this.rpcPoint(cfg, metric, caller, callee, latency, code, EnhanceRpcVersion, tags)
+	p.ctxTags = ctxTags(ctx)
+	return this.pushPoint(cfg, &p)
+}
+
+func (this *Client) CounterCtx(ctx context.Context, metric string, tags ...map[string]string) error {
+	return this.CounterNCtx(ctx, metric, 1, tags...)
+}
+
+func (this *Client) CounterNCtx(ctx context.Context, metric string, cnt int, tags ...map[string]string) error {
+	cfg := this.config()
+	p := this.counterPoint(cfg, metric, cnt, "c", tags)
+	p.ctxTags = ctxTags(ctx)
+	return this.pushPoint(cfg, &p)
+}
+
+func (this *Client) GaugeCtx(ctx context.Context, metric string, value float64, tags ...map[string]string) error {
+	cfg := this.config()
+	p := this.gaugePoint(cfg, metric, value, tags)
+	p.ctxTags = ctxTags(ctx)
+	return this.pushPoint(cfg, &p)
+}
@@ -0,0 +1,102 @@
+package statsdlib
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCtxTags(t *testing.T) {
+	tr := NewMemTransport()
+	c, _ := NewClient(WithTransport(tr), WithNs("ns"))
+	defer c.Close(context.Background())
+
+	ctx := WithTags(context.Background(), "tenant", "t1")
+	ctx = WithTagMap(ctx, map[string]string{"route": "/a", "caller": "ctx"})
+	ctx = WithTags(ctx, "tenant", "t2") // 后设置的覆盖先设置的
+
+	c.CounterCtx(ctx, "hit", map[string]string{"route": "/b"})
+	c.RpcMetricCtx(ctx, "rpc", "a", "b", time.Millisecond, "ok")
+	c.GaugeCtx(context.Background(), "mem", 1)
+
+	want := []string{
+		"1\nns/hit\ncaller=ctx\nroute=/b\ntenant=t2\nc",
+		"1,ok\nns/rpc\ncallee=b\ncaller=a\nroute=/a\ntenant=t2\nrpc",
+		"1.000000\nns/mem\ng",
+	}
+	payloads := tr.Payloads()
+	if len(payloads) != len(want) {
+		t.Fatalf("bad payloads: %q", payloads)
+	}
+	for i, w := range want {
+		if string(payloads[i]) != w {
+			t.Errorf("payload %d: got %q, want %q", i, payloads[i], w)
+		}
+	}
+
+	tags := TagsFromContext(ctx)
+	tags["tenant"] = "changed"
+	if TagsFromContext(ctx)["tenant"] != "t2" {
+		t.Errorf("TagsFromContext should return a copy")
+	}
+}
+
+func TestCtxTagsLimit(t *testing.T) {
+	limits := Limits{MaxTagCnt: 3}
+	ctx := WithTagMap(context.Background(), map[string]string{"a": "1", "b": "2"})
+	tags := map[string]string{"y": "1", "z": "2"}
+
+	tr := NewMemTransport()
+	c, _ := NewClient(WithTransport(tr), WithNs("ns"), WithLimits(limits))
+	if err := c.CounterCtx(ctx, "m", tags); !errors.Is(err, ErrTooManyTags) {
+		t.Errorf("reject: unexpected error %v", err)
+	}
+	c.Close(context.Background())
+
+	// 先丢弃context中的tags
+	tr = NewMemTransport()
+	c, _ = NewClient(WithTransport(tr), WithNs("ns"), WithLimits(limits), WithLimitPolicy(LimitDrop))
+	if err := c.CounterCtx(ctx, "m", tags); err != nil {
+		t.Errorf("drop: unexpected error %v", err)
+	}
+	if p := tr.Payloads(); len(p) != 1 || string(p[0]) != "1\nns/m\na=1\ny=1\nz=2\nc" {
+		t.Errorf("drop: bad payloads %q", p)
+	}
+	if st := c.LimitStats(); st.Dropped != 1 {
+		t.Errorf("drop: bad stats %+v", st)
+	}
+	c.Close(context.Background())
+}
+
+func TestCtxTagsAggregation(t *testing.T) {
+	tr := NewMemTransport()
+	c, _ := NewClient(WithTransport(tr), WithNs("ns"), WithCounterAggregation(time.Hour))
+
+	ctx := WithTags(context.Background(), "tenant", "t1")
+	c.CounterCtx(ctx, "hit")
+	c.CounterCtx(ctx, "hit")
+	c.Counter("hit", map[string]string{"tenant": "t1"})
+	c.Close(context.Background())
+
+	if p := tr.Payloads(); len(p) != 1 || string(p[0]) != "3\nns/hit\ntenant=t1\nc" {
+		t.Errorf("bad payloads: %q", p)
+	}
+}
+
+func TestCtxTagsAllocs(t *testing.T) {
+	skipAllocsUnderRace(t)
+	c := newBenchClient(t)
+	defer c.Close(context.Background())
+
+	ctx := WithTags(context.Background(), "tenant", "t1")
+	tags := map[string]string{"api": "login"}
+	for name, fn := range map[string]func(){
+		"CounterCtx":   func() { c.CounterCtx(ctx, "api.hit", tags) },
+		"RpcMetricCtx": func() { c.RpcMetricCtx(ctx, "rpc", "a", "b", time.Millisecond, "ok", tags) },
+	} {
+		if allocs := testing.AllocsPerRun(100, fn); allocs != 0 {
+			t.Errorf("%s: %.1f allocs/op", name, allocs)
+		}
+	}
+}
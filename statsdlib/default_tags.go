@@ -0,0 +1,85 @@
+package statsdlib
+
+import (
+	"fmt"
+)
+
+/***************************************************************************
+ * 默认tags: Client上报的所有metric都带上的tags, 如 host/module/cluster/version/region,
+ * 调用时传入的同名tag(包括rpc的caller/callee和context中的tags)优先
+ * 默认tags在设置时校验, 并占用固定的tag个数: 调用时最多还能传 MaxTagCnt-len(默认tags) 个tag,
+ * 超出时按LimitPolicy处理, 默认tags不会被丢弃; 最多 MaxTagCnt-2 个, 给rpc的caller/callee留出位置
+ * SetDefaultTags 可以在运行时调用, 整体替换, 对之后的上报生效
+ **************************************************************************/
+
+/**
+ * @note
+ * 设置默认Client的默认tags, 整体替换, 传入nil时清空
+ * @param map $tags
+ *
+ * @return error 不合法时返回错误, 原来的默认tags不变
+ */
+func SetDefaultTags(tags map[string]string) error {
+	return defaultClient().SetDefaultTags(tags)
+}
+
+// 默认Client的默认tags, 返回拷贝
+func DefaultTags() map[string]string {
+	return defaultClient().DefaultTags()
+}
+
+func (this *Client) SetDefaultTags(tags map[string]string) error {
+	return this.updateConfig(func(cfg *clientConfig) error {
+		checked, err := checkDefaultTags(tags, cfg.limits, this.chars)
+		if err != nil {
+			return err
+		}
+		cfg.defTags = checked
+		return nil
+	})
+}
+
+func (this *Client) DefaultTags() map[string]string {
+	src := this.config().defTags
+	if src == nil {
+		return nil
+	}
+	tags := make(map[string]string, len(src))
+	for k, v := range src {
+		tags[k] = v
+	}
+	return tags
+}
+
+// 默认tags之外固定占用的tag个数, 即rpc的caller/callee
+const rpcReservedTagCnt = 2
+
+// 校验并拷贝默认tags, 非法字符按CharPolicy处理, 超出限制时总是返回错误
+func checkDefaultTags(tags map[string]string, limits Limits, policy CharPolicy) (map[string]string, error) {
+	if len(tags) == 0 {
+		return nil, nil
+	}
+	if max := limits.MaxTagCnt - rpcReservedTagCnt; len(tags) > max {
+		return nil, fmt.Errorf("%w: %d default tags > %d", ErrTooManyTags, len(tags), max)
+	}
+
+	tags, err := sanitizeTags(tags, policy)
+	if err != nil {
+		return nil, err
+	}
+	checked := make(map[string]string, len(tags))
+	for k, v := range tags {
+		switch {
+		case k == "":
+			return nil, &TagError{Key: k, Value: v, Reason: ErrEmptyTagk}
+		case len(k) > limits.MaxTagkLen:
+			return nil, &TagError{Key: k, Value: v, Reason: ErrTagkTooLong}
+		case v == "":
+			return nil, &TagError{Key: k, Value: v, Reason: ErrEmptyTagv}
+		case len(v) > limits.MaxTagvLen:
+			return nil, &TagError{Key: k, Value: v, Reason: ErrTagvTooLong}
+		}
+		checked[k] = v
+	}
+	return checked, nil
+}
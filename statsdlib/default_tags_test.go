@@ -0,0 +1,183 @@
+package statsdlib
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDefaultTags(t *testing.T) {
+	tr := NewMemTransport()
+	c, err := NewClient(WithTransport(tr), WithNs("ns"), WithDefaultTags(map[string]string{"host": "h1", "region": "cn", "caller": "def"}))
+	if err != nil {
+		t.Fatalf("new client error: %s", err.Error())
+	}
+	defer c.Close(context.Background())
+
+	ctx := WithTags(context.Background(), "region", "ctx")
+	c.Counter("hit", map[string]string{"host": "h2"})
+	c.CounterCtx(ctx, "hit")
+	c.RpcMetric("rpc", "a", "b", time.Millisecond, "ok")
+
+	want := []string{
+		"1\nns/hit\ncaller=def\nhost=h2\nregion=cn\nc",
+		"1\nns/hit\ncaller=def\nhost=h1\nregion=ctx\nc",
+		"1,ok\nns/rpc\ncallee=b\ncaller=a\nhost=h1\nregion=cn\nrpc",
+	}
+	payloads := tr.Payloads()
+	if len(payloads) != len(want) {
+		t.Fatalf("bad payloads: %q", payloads)
+	}
+	for i, w := range want {
+		if string(payloads[i]) != w {
+			t.Errorf("payload %d: got %q, want %q", i, payloads[i], w)
+		}
+	}
+
+	// 不合法时返回错误, 原来的默认tags不变
+	if err := c.SetDefaultTags(map[string]string{"k": ""}); !errors.Is(err, ErrEmptyTagv) {
+		t.Errorf("expect empty tagv error, got %v", err)
+	}
+	if c.DefaultTags()["host"] != "h1" {
+		t.Errorf("default tags changed by invalid SetDefaultTags: %v", c.DefaultTags())
+	}
+	c.SetDefaultTags(nil)
+	if c.DefaultTags() != nil {
+		t.Errorf("default tags not cleared")
+	}
+}
+
+func TestDefaultTagsLimit(t *testing.T) {
+	def := map[string]string{"host": "h", "region": "cn"}
+	tags := map[string]string{"a": "1", "b": "2", "c": "3"}
+
+	c, _ := NewClient(WithTransport(NewMemTransport()), WithNs("ns"), WithLimits(Limits{MaxTagCnt: 4}), WithDefaultTags(def))
+	if err := c.Counter("m", tags); !errors.Is(err, ErrTooManyTags) {
+		t.Errorf("reject: unexpected error %v", err)
+	}
+	if err := c.Counter("m", map[string]string{"a": "1", "host": "h2"}); err != nil {
+		t.Errorf("overridden default tag should not be counted twice: %v", err)
+	}
+	if c.NewCounterVec("m", "a", "b", "c").Err() == nil {
+		t.Errorf("vec declaration should count default tags")
+	}
+	if err := c.SetDefaultTags(map[string]string{"a": "1", "b": "2", "c": "3"}); !errors.Is(err, ErrTooManyTags) {
+		t.Errorf("expect too many default tags, got %v", err)
+	}
+	c.Close(context.Background())
+
+	// 默认tags不会被丢弃
+	tr := NewMemTransport()
+	c, _ = NewClient(WithTransport(tr), WithNs("ns"), WithLimits(Limits{MaxTagCnt: 4}), WithDefaultTags(def), WithLimitPolicy(LimitDrop))
+	c.Counter("m", tags)
+	if p := tr.Payloads(); len(p) != 1 || string(p[0]) != "1\nns/m\na=1\nb=2\nhost=h\nregion=cn\nc" {
+		t.Errorf("drop: bad payloads %q", p)
+	}
+	c.Close(context.Background())
+
+	if _, err := NewClient(WithTransport(NewMemTransport()), WithDefaultTags(map[string]string{"": "v"})); !errors.Is(err, ErrEmptyTagk) {
+		t.Errorf("expect NewClient error for invalid default tags, got %v", err)
+	}
+}
+
+// 默认tags最多 MaxTagCnt-2 个, rpc的caller/callee总有位置
+func TestDefaultTagsRpcReserved(t *testing.T) {
+	tags := map[string]string{}
+	for i := 0; i < maxTagCnt-1; i++ {
+		tags["k"+strconv.Itoa(i)] = "v"
+	}
+	if _, err := NewClient(WithTransport(NewMemTransport()), WithDefaultTags(tags)); !errors.Is(err, ErrTooManyTags) {
+		t.Errorf("expect too many default tags, got %v", err)
+	}
+
+	delete(tags, "k0")
+	tr := NewMemTransport()
+	c, err := NewClient(WithTransport(tr), WithNs("ns"), WithDefaultTags(tags), WithLimitPolicy(LimitTruncate))
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	defer c.Close(context.Background())
+	if err := c.RpcMetric("rpc", "a", "b", time.Millisecond, "ok", map[string]string{"x": "1"}); err != nil {
+		t.Errorf("rpc with full default tags: %v", err)
+	}
+	if m, _ := Decode(tr.Payloads()[0]); m.Tags["caller"] != "a" || m.Tags["callee"] != "b" || len(m.Tags) != maxTagCnt {
+		t.Errorf("bad tags: %v", m.Tags)
+	}
+	if err := c.SetLimits(Limits{MaxTagCnt: maxTagCnt - 1}); !errors.Is(err, ErrTooManyTags) {
+		t.Errorf("SetLimits: expect too many tags, got %v", err)
+	}
+	if c.Limits().MaxTagCnt != maxTagCnt {
+		t.Errorf("limits changed after failed SetLimits: %+v", c.Limits())
+	}
+}
+
+func TestDefaultTagsHandle(t *testing.T) {
+	tr := NewMemTransport()
+	c, _ := NewClient(WithTransport(tr), WithNs("ns"))
+	defer c.Close(context.Background())
+
+	hit := c.NewCounter("hit")
+	hit.Inc()
+	c.SetDefaultTags(map[string]string{"version": "1.2"})
+	hit.Inc()
+
+	p := tr.Payloads()
+	if len(p) != 2 || string(p[0]) != "1\nns/hit\nc" || string(p[1]) != "1\nns/hit\nversion=1.2\nc" {
+		t.Errorf("bad payloads: %q", p)
+	}
+}
+
+func TestConfigMetaTags(t *testing.T) {
+	tr := NewMemTransport()
+	c, err := Config{Transport: tr, Ns: "ns", Module: "mod", Cluster: "c1", MetaTags: true, DefaultTags: map[string]string{"cluster": "c2", "version": "1.0"}}.newClient()
+	if err != nil {
+		t.Fatalf("new client error: %s", err.Error())
+	}
+	defer c.Close(context.Background())
+
+	host, _ := os.Hostname()
+	tags := c.DefaultTags()
+	if tags["host"] != host || tags["module"] != "mod" || tags["cluster"] != "c2" || tags["version"] != "1.0" {
+		t.Errorf("bad default tags: %v", tags)
+	}
+	if _, found := tags["service_name"]; found {
+		t.Errorf("empty service_name should not be a tag: %v", tags)
+	}
+}
+
+func TestDefaultTagsConcurrent(t *testing.T) {
+	c, _ := NewClient(WithTransport(discardTransport{}), WithNs("ns"), WithCounterAggregation(time.Millisecond))
+	defer c.Close(context.Background())
+	hit := c.NewCounter("hit")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				c.Counter("m", map[string]string{"k": "v"})
+				hit.Inc()
+			}
+		}()
+	}
+	for j := 0; j < 100; j++ {
+		c.SetDefaultTags(map[string]string{"version": strconv.Itoa(j)})
+	}
+	wg.Wait()
+}
+
+func TestDefaultTagsAllocs(t *testing.T) {
+	skipAllocsUnderRace(t)
+	c := newBenchClient(t, WithDefaultTags(map[string]string{"host": "h1", "region": "cn"}))
+	defer c.Close(context.Background())
+
+	tags := map[string]string{"api": "login"}
+	if allocs := testing.AllocsPerRun(100, func() { c.Counter("api.hit", tags) }); allocs != 0 {
+		t.Errorf("Counter: %.1f allocs/op", allocs)
+	}
+}
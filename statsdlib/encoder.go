@@ -0,0 +1,317 @@
+package statsdlib
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/***************************************************************************
+ * 编码: 上报接口在栈上构造point, 直接编码到 sync.Pool 管理的buffer里,
+ * 热路径上没有map、string和[]byte的分配; metricBuilder 也转成point编码
+ **************************************************************************/
+
+type valueKind uint8
+
+const (
+	valueRaw    valueKind = iota // 原始字符串 sval, 来自metricBuilder
+	valueInt                     // c/ce 计数 ival
+	valueFloat                   // g/percentile fval
+	valueRatio                   // rt, code为sval
+	valueRatioN                  // rt, <ival>,<sval>
+	valueRpc                     // rpc/rpce, <ival>,<code>[,<success>]
+)
+
+// 一条待上报的metric
+type point struct {
+	ns          string
+	metric      string
+	aggregator  string
+	percentiles []string          // aggregator 为分位值列表时使用
+	tags        map[string]string // 调用方传入的tags, 只读
+	ctxTags     map[string]string // context中的tags, 只读, 见 ctxtags.go
+	defTags     map[string]string // Client的默认tags, 只读, 见 SetDefaultTags
+
+	// rpc 的 caller/callee, tags 中有同名key时以tags为准, 优先于ctxTags
+	rpcTags bool
+	caller  string
+	callee  string
+
+	kind    valueKind
+	ival    int64
+	fval    float64
+	sval    string
+	cval    int64 // rpc 整数code
+	codeInt bool  // rpc code 为整数, 见 cval
+	fail    bool  // rpc 调用失败, 见 code.go
+}
+
+// rpc code 归一化, 见 code.go; 默认规则下整数和字符串不分配内存
+func (this *point) setCode(code interface{}, classifier CodeClassifier) {
+	if classifier != nil {
+		var ok bool
+		this.sval, ok = classifier(code)
+		this.fail = !ok
+		return
+	}
+
+	if v, ok := code.(string); ok {
+		this.sval, this.fail = v, !successCodes[v]
+		return
+	}
+	if n, ok := codeInt(code); ok {
+		this.cval, this.codeInt, this.fail = n, true, !intCodeSuccess(n)
+		return
+	}
+	var ok bool
+	this.sval, ok = ClassifyCode(code)
+	this.fail = !ok
+}
+
+// agent按默认规则(successCodes)判断code成功与否
+func (this *point) codeSuccess() bool {
+	if this.codeInt {
+		return intCodeSuccess(this.cval)
+	}
+	return successCodes[this.sval]
+}
+
+// tag的来源, 同名key时前面的优先
+type tagSource uint8
+
+const (
+	tagFromCall    tagSource = iota // 调用时显式传入的tags
+	tagFromRpc                      // rpc的caller/callee
+	tagFromCtx                      // context中的tags, 见 ctxtags.go
+	tagFromDefault                  // Client的默认tags, 见 SetDefaultTags
+)
+
+// 依次访问合并后的tags, 返回false时停止
+// 同名key的优先级: tags > caller/callee > ctxTags > defTags
+func (this *point) eachTag(fn func(k string, v string, src tagSource) bool) {
+	if this.rpcTags {
+		if _, found := this.tags["caller"]; !found && !fn("caller", this.caller, tagFromRpc) {
+			return
+		}
+		if _, found := this.tags["callee"]; !found && !fn("callee", this.callee, tagFromRpc) {
+			return
+		}
+	}
+	for k, v := range this.tags {
+		if !fn(k, v, tagFromCall) {
+			return
+		}
+	}
+	for k, v := range this.ctxTags {
+		if !this.ctxShadowed(k) && !fn(k, v, tagFromCtx) {
+			return
+		}
+	}
+	for k, v := range this.defTags {
+		if !this.defShadowed(k) && !fn(k, v, tagFromDefault) {
+			return
+		}
+	}
+}
+
+// ctxTags中的k被tags或caller/callee覆盖
+func (this *point) ctxShadowed(k string) bool {
+	if _, found := this.tags[k]; found {
+		return true
+	}
+	return this.rpcTags && (k == "caller" || k == "callee")
+}
+
+// defTags中的k被其他来源覆盖
+func (this *point) defShadowed(k string) bool {
+	if _, found := this.ctxTags[k]; found {
+		return true
+	}
+	return this.ctxShadowed(k)
+}
+
+func (this *point) tagCnt() int {
+	cnt := len(this.tags)
+	if this.rpcTags {
+		if _, found := this.tags["caller"]; !found {
+			cnt++
+		}
+		if _, found := this.tags["callee"]; !found {
+			cnt++
+		}
+	}
+	for k := range this.ctxTags {
+		if !this.ctxShadowed(k) {
+			cnt++
+		}
+	}
+	for k := range this.defTags {
+		if !this.defShadowed(k) {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+func (this *point) tagValue(k string) string {
+	if v, found := this.tags[k]; found {
+		return v
+	}
+	if this.rpcTags {
+		switch k {
+		case "caller":
+			return this.caller
+		case "callee":
+			return this.callee
+		}
+	}
+	if v, found := this.ctxTags[k]; found {
+		return v
+	}
+	return this.defTags[k]
+}
+
+// 合并后的tags, 会分配新的map
+func (this *point) mergedTags() map[string]string {
+	if !this.rpcTags && this.tags == nil && this.ctxTags == nil && this.defTags == nil {
+		return nil
+	}
+	tags := make(map[string]string, this.tagCnt())
+	this.eachTag(func(k string, v string, src tagSource) bool {
+		tags[k] = v
+		return true
+	})
+	return tags
+}
+
+// 用合并后的tags替换tags, 之后不再区分来源
+func (this *point) setTags(tags map[string]string) {
+	this.tags, this.rpcTags, this.ctxTags, this.defTags = tags, false, nil, nil
+}
+
+func (this *point) appendValue(b []byte) []byte {
+	switch this.kind {
+	case valueInt:
+		return strconv.AppendInt(b, this.ival, 10)
+	case valueFloat:
+		return strconv.AppendFloat(b, this.fval, 'f', 6, 64)
+	case valueRatioN:
+		b = strconv.AppendInt(b, this.ival, 10)
+		b = append(b, ',')
+		return append(b, this.sval...)
+	case valueRpc:
+		b = strconv.AppendInt(b, this.ival, 10)
+		b = append(b, ',')
+		b = this.appendCode(b)
+		// 与agent默认规则的判断不同时(error的Code()、grpc code名称、自定义 CodeClassifier), 附加明确的成功/失败
+		if this.fail == this.codeSuccess() {
+			b = append(b, ',')
+			b = strconv.AppendBool(b, !this.fail)
+		}
+		return b
+	}
+	return append(b, this.sval...)
+}
+
+func (this *point) appendCode(b []byte) []byte {
+	if this.codeInt {
+		return strconv.AppendInt(b, this.cval, 10)
+	}
+	return append(b, this.sval...)
+}
+
+func (this *point) appendAggregator(b []byte) []byte {
+	if this.percentiles == nil {
+		return append(b, this.aggregator...)
+	}
+	for i, p := range this.percentiles {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = append(b, p...)
+	}
+	return b
+}
+
+// <ns>/<metric>\n<tagk>=<tagv>..., tags按key排序
+func (this *point) appendSeries(b []byte) []byte {
+	b = append(b, this.ns...)
+	b = append(b, '/')
+	b = append(b, this.metric...)
+
+	var arr [16]string
+	keys := arr[:0]
+	if cnt := this.tagCnt(); cnt > len(arr) {
+		keys = make([]string, 0, cnt)
+	}
+	this.eachTag(func(k string, v string, src tagSource) bool {
+		keys = append(keys, k)
+		return true
+	})
+	sortStrings(keys)
+
+	for _, k := range keys {
+		b = append(b, '\n')
+		b = append(b, k...)
+		b = append(b, '=')
+		b = append(b, this.tagValue(k)...)
+	}
+	return b
+}
+
+// 完整的一条记录, 与 Build() 一致
+func (this *point) appendRecord(b []byte) []byte {
+	b = this.appendValue(b)
+	b = append(b, '\n')
+	b = this.appendSeries(b)
+	b = append(b, '\n')
+	return this.appendAggregator(b)
+}
+
+// 同 appendRecord, 使用已编码好的序列
+func (this *point) appendRecordSeries(b []byte, series []byte) []byte {
+	b = this.appendValue(b)
+	b = append(b, '\n')
+	b = append(b, series...)
+	b = append(b, '\n')
+	return this.appendAggregator(b)
+}
+
+// 插入排序, tags很少, 不分配内存
+func sortStrings(s []string) {
+	for i := 1; i < len(s); i++ {
+		for j := i; j > 0 && s[j] < s[j-1]; j-- {
+			s[j], s[j-1] = s[j-1], s[j]
+		}
+	}
+}
+
+// 编码buffer池
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 512)
+		return &b
+	},
+}
+
+func getBuf() *[]byte {
+	return bufPool.Get().(*[]byte)
+}
+
+func putBuf(b *[]byte) {
+	// 过大的buffer不放回, 避免长期占用内存
+	if cap(*b) > 64*1024 {
+		return
+	}
+	*b = (*b)[:0]
+	bufPool.Put(b)
+}
+
+// 去掉url中的query部分
+func trimQuery(s string) string {
+	pos := strings.Index(s, "?")
+	if pos > 0 {
+		return s[:pos]
+	}
+	return s
+}
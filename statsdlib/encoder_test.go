@@ -0,0 +1,108 @@
+package statsdlib
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// 丢弃所有内容, 用于benchmark
+type discardTransport struct{}
+
+func (discardTransport) Send(body []byte) error { return nil }
+func (discardTransport) Close() error           { return nil }
+
+var raceEnabled bool
+
+func skipAllocsUnderRace(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocs are not accurate under -race")
+	}
+}
+
+func newBenchClient(tb testing.TB, opts ...Option) *Client {
+	c, err := NewClient(append([]Option{WithTransport(discardTransport{}), WithNs("bench.ns")}, opts...)...)
+	if err != nil {
+		tb.Fatalf("new client error: %s", err.Error())
+	}
+	return c
+}
+
+func TestEncoderAllocs(t *testing.T) {
+	skipAllocsUnderRace(t)
+	c := newBenchClient(t)
+	defer c.Close(context.Background())
+	tags := map[string]string{"api": "login", "idc": "bj"}
+
+	cases := map[string]func(){
+		"Counter":    func() { c.Counter("api.hit", tags) },
+		"Gauge":      func() { c.Gauge("mem.used", 1024.5, tags) },
+		"RpcMetric":  func() { c.RpcMetric("rpc", "caller", "callee", 12*time.Millisecond, "ok", tags) },
+		"RpcIntCode": func() { c.RpcMetric("rpc", "caller", "/api/v1/user?id=1", 12*time.Millisecond, 200) },
+		"RatioN":     func() { c.RatioN("ratio", "ok", 3) },
+	}
+	for name, fn := range cases {
+		if allocs := testing.AllocsPerRun(100, fn); allocs != 0 {
+			t.Errorf("%s: %.1f allocs/op", name, allocs)
+		}
+	}
+
+	// 聚合已有的key时也不分配内存
+	aggr := newBenchClient(t, WithCounterAggregation(time.Hour), WithRpcAggregation(time.Hour))
+	defer aggr.Close(context.Background())
+	for name, fn := range map[string]func(){
+		"AggrCounter": func() { aggr.Counter("api.hit", tags) },
+		"AggrRpc":     func() { aggr.RpcMetric("rpc", "caller", "callee", 12*time.Millisecond, "ok", tags) },
+	} {
+		fn()
+		if allocs := testing.AllocsPerRun(100, fn); allocs != 0 {
+			t.Errorf("%s: %.1f allocs/op", name, allocs)
+		}
+	}
+}
+
+func BenchmarkCounter(b *testing.B) {
+	c := newBenchClient(b)
+	defer c.Close(context.Background())
+	tags := map[string]string{"api": "login", "idc": "bj"}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c.Counter("api.hit", tags)
+	}
+}
+
+func BenchmarkGauge(b *testing.B) {
+	c := newBenchClient(b)
+	defer c.Close(context.Background())
+	tags := map[string]string{"host": "10.0.0.1"}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c.Gauge("mem.used", 1024.5, tags)
+	}
+}
+
+func BenchmarkRpcMetric(b *testing.B) {
+	c := newBenchClient(b)
+	defer c.Close(context.Background())
+	tags := map[string]string{"idc": "bj"}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c.RpcMetric("rpc.user_service", "all", "user_login", 12*time.Millisecond, "200", tags)
+	}
+}
+
+func BenchmarkRpcMetricAggregated(b *testing.B) {
+	c := newBenchClient(b, WithRpcAggregation(time.Hour))
+	defer c.Close(context.Background())
+	tags := map[string]string{"idc": "bj"}
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c.RpcMetric("rpc.user_service", "all", "user_login", 12*time.Millisecond, "200", tags)
+		}
+	})
+}
@@ -0,0 +1,70 @@
+package statsdlib
+
+import (
+	"errors"
+	"fmt"
+)
+
+/***************************************************************************
+ * 校验错误: 可以用 errors.Is 判断原因, 用 errors.As 取出出错的tag
+ *   if errors.Is(err, statsd.ErrTagvTooLong) { ... }
+ *   var tagErr *statsd.TagError
+ *   if errors.As(err, &tagErr) { ... tagErr.Key ... }
+ * CheckAll 把所有错误用 errors.Join 合并返回, 同样可以用 errors.Is/As 判断
+ **************************************************************************/
+var (
+	ErrEmptyNs       = errors.New("empty ns")
+	ErrEmptyMetric   = errors.New("empty metric")
+	ErrMetricTooLong = errors.New("metric too long")
+	ErrTooManyTags   = errors.New("too many tags")
+	ErrEmptyTagk     = errors.New("empty tagk")
+	ErrTagkTooLong   = errors.New("tagk too long")
+	ErrEmptyTagv     = errors.New("empty tagv")
+	ErrTagvTooLong   = errors.New("tagv too long")
+	ErrIllegalChar   = errors.New("illegal char")
+	ErrNoPercentile  = errors.New("percentile not defined")
+
+	// CounterVec/RpcVec
+	ErrDuplicateLabel = errors.New("duplicate label")
+	ErrLabelCount     = errors.New("label values count mismatch")
+
+	// Client 已经关闭, 见 Close
+	ErrClosed = errors.New("client closed")
+)
+
+// 某个tag不合法, Reason 为上面的 ErrXxx 之一
+type TagError struct {
+	Key    string
+	Value  string
+	Reason error
+}
+
+func (this *TagError) Error() string {
+	return fmt.Sprintf("%s: %s=%s", this.Reason.Error(), this.Key, this.Value)
+}
+
+func (this *TagError) Unwrap() error {
+	return this.Reason
+}
+
+// 收集校验错误, all为false时只保留第一个
+type errCollector struct {
+	all  bool
+	errs []error
+}
+
+// 返回是否继续校验
+func (this *errCollector) add(err error) bool {
+	this.errs = append(this.errs, err)
+	return this.all
+}
+
+func (this *errCollector) err() error {
+	switch len(this.errs) {
+	case 0:
+		return nil
+	case 1:
+		return this.errs[0]
+	}
+	return errors.Join(this.errs...)
+}
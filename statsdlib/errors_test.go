@@ -0,0 +1,67 @@
+package statsdlib
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestErrorsIs(t *testing.T) {
+	c, _ := NewClient(WithTransport(NewMemTransport()), WithNs("ns"), WithCharPolicy(CharStrict))
+	defer c.Close(context.Background())
+
+	long := strings.Repeat("x", maxTagvLen+1)
+	cases := []struct {
+		err    error
+		reason error
+		key    string
+	}{
+		{c.Counter(""), ErrEmptyMetric, ""},
+		{c.Counter(strings.Repeat("m", maxMetricLen+1)), ErrMetricTooLong, ""},
+		{c.Counter("m", map[string]string{"a": "1", "b": "2", "c": "3", "d": "4", "e": "5", "f": "6", "g": "7", "h": "8", "i": "9"}), ErrTooManyTags, ""},
+		{c.Counter("m", map[string]string{"": "v"}), ErrEmptyTagk, ""},
+		{c.Counter("m", map[string]string{long: "v"}), ErrTagkTooLong, long},
+		{c.Counter("m", map[string]string{"k": ""}), ErrEmptyTagv, "k"},
+		{c.Counter("m", map[string]string{"k": long}), ErrTagvTooLong, "k"},
+		{c.Counter("m", map[string]string{"k": "a=b"}), ErrIllegalChar, "k"},
+		{c.RpcMetric("rpc", "a\nb", "c", 0, "ok"), ErrIllegalChar, "caller"},
+		{c.Percentile("m", 1, nil), ErrNoPercentile, ""},
+		{c.NewCounterVec("m", "a", "a").Err(), ErrDuplicateLabel, "a"},
+		{c.NewCounterVec("m", "a").With().Inc(), ErrLabelCount, ""},
+	}
+	for i, cs := range cases {
+		if !errors.Is(cs.err, cs.reason) {
+			t.Errorf("case %d: %v is not %v", i, cs.err, cs.reason)
+			continue
+		}
+		var tagErr *TagError
+		if cs.key != "" && (!errors.As(cs.err, &tagErr) || tagErr.Key != cs.key) {
+			t.Errorf("case %d: expect TagError of %s, got %v", i, cs.key, cs.err)
+		}
+	}
+}
+
+func TestCheckAll(t *testing.T) {
+	mb := metricBuilder{}.Name("").Ns("ns").Tag("k", "").Tag("k2", strings.Repeat("v", maxTagvLen+1)).Agg("1", "c")
+
+	if err := mb.Check(); !errors.Is(err, ErrEmptyMetric) || errors.Is(err, ErrEmptyTagv) {
+		t.Errorf("Check should return the first error only: %v", err)
+	}
+
+	err := mb.CheckAll()
+	for _, reason := range []error{ErrEmptyMetric, ErrEmptyTagv, ErrTagvTooLong} {
+		if !errors.Is(err, reason) {
+			t.Errorf("CheckAll: %v is not %v", err, reason)
+		}
+	}
+	var tagErr *TagError
+	if !errors.As(err, &tagErr) {
+		t.Errorf("CheckAll: expect TagError in %v", err)
+	}
+
+	ok := metricBuilder{}.Name("m").Ns("ns").Tag("k", "v").Agg("1", "c")
+	if err := ok.CheckAll(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,258 @@
+package statsdlib
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+/***************************************************************************
+ * 预注册的metric: 名称和tags固定, 创建后只校验一次, 缓存编码好的
+ * ns/metric/tags, 每次上报只编码value, 适合同一个metric+tags的高频上报
+ *   hit := statsd.NewCounter("api.hit", map[string]string{"api": "login"})
+ *   hit.Inc()
+ * 包级别的 NewXxx 跟随默认Client, Init 替换默认Client或修改配置(ns、默认tags、限制)后自动重新校验和编码
+ **************************************************************************/
+
+// 绑定到某个Client后的校验和编码结果, 只读
+type handleState struct {
+	client *Client
+	cfg    *clientConfig
+	p      point
+	series []byte
+	fit    limitFit // 校验时截断和丢弃的个数, 每次上报计入一次
+	err    error
+}
+
+type handle struct {
+	client   *Client // nil时使用默认Client
+	newPoint func(c *Client, cfg *clientConfig) point
+	state    atomic.Pointer[handleState]
+	failed   *handleState // 创建时已经确定的错误, 见 failedHandle
+}
+
+func newHandle(c *Client, newPoint func(c *Client, cfg *clientConfig) point) handle {
+	return handle{client: c, newPoint: newPoint}
+}
+
+// 每次上报都返回err的handle, c为nil时使用默认Client计数
+func failedHandle(c *Client, err error) handle {
+	return handle{client: c, failed: &handleState{err: err}}
+}
+
+// 当前Client对应的校验和编码结果, Client或配置快照变化时重新生成
+func (this *handle) bind() *handleState {
+	if this.failed != nil {
+		return this.failed
+	}
+	c := this.client
+	if c == nil {
+		c = defaultClient()
+	}
+	st := this.state.Load()
+	cfg := c.config()
+	if st != nil && st.client == c && st.cfg == cfg {
+		return st
+	}
+
+	st = &handleState{client: c, cfg: cfg, p: this.newPoint(c, cfg)}
+	st.p.defTags = cfg.defTags
+	st.err = st.p.sanitize(c.chars)
+	if st.err == nil {
+		st.fit, st.err = st.p.checkLimits(cfg.limits, c.limitPol)
+	}
+	if st.err == nil {
+		st.series = st.p.appendSeries(nil)
+	}
+	this.state.Store(st)
+	return st
+}
+
+// 校验失败, 计入Client的统计
+func (this *handle) reject(st *handleState) error {
+	c := st.client
+	if c == nil {
+		c = this.client
+	}
+	if c == nil {
+		c = defaultClient()
+	}
+	c.limitCnt.record(st.fit, st.err)
+	c.stats.addInvalid(st.err)
+	return st.err
+}
+
+// 发送校验过的point, 同 pushPoint 每次计入截断和丢弃的个数
+func (this *handleState) push(p *point) error {
+	this.client.limitCnt.record(this.fit, nil)
+	return this.client.pushPrepared(p, this.series)
+}
+
+// 创建时校验的结果, nil表示可以正常上报
+func (this *handle) Err() error {
+	return this.bind().err
+}
+
+// 拷贝tags, 之后调用方修改tags不影响handle
+func copyTags(tags []map[string]string) map[string]string {
+	src := firstTags(tags)
+	if src == nil {
+		return nil
+	}
+	dst := make(map[string]string, len(src))
+	for k, v := range src {
+		dst[k] = v
+	}
+	return dst
+}
+
+// counter
+type CounterHandle struct {
+	handle
+}
+
+/**
+ * @note
+ * 创建counter, 使用默认Client
+ * @param string $metric 计数指标名称
+ * @param map    $tags   可选的tag
+ *
+ * @return *CounterHandle
+ */
+func NewCounter(metric string, tags ...map[string]string) *CounterHandle {
+	return newCounter(nil, metric, "c", copyTags(tags))
+}
+
+// 同 NewCounter, 使用ce
+func NewCounterE(metric string, tags ...map[string]string) *CounterHandle {
+	return newCounter(nil, metric, "ce", copyTags(tags))
+}
+
+func (this *Client) NewCounter(metric string, tags ...map[string]string) *CounterHandle {
+	return newCounter(this, metric, "c", copyTags(tags))
+}
+
+func (this *Client) NewCounterE(metric string, tags ...map[string]string) *CounterHandle {
+	return newCounter(this, metric, "ce", copyTags(tags))
+}
+
+func newCounter(c *Client, metric string, aggr string, tags map[string]string) *CounterHandle {
+	return &CounterHandle{handle: newHandle(c, func(c *Client, cfg *clientConfig) point {
+		return c.counterPoint(cfg, metric, 0, aggr, []map[string]string{tags})
+	})}
+}
+
+func (this *CounterHandle) Inc() error {
+	return this.Add(1)
+}
+
+func (this *CounterHandle) Add(cnt int) error {
+	st := this.bind()
+	if st.err != nil {
+		return this.reject(st)
+	}
+	p := st.p
+	p.ival = int64(cnt)
+	return st.push(&p)
+}
+
+// gauge
+type GaugeHandle struct {
+	handle
+}
+
+/**
+ * @note
+ * 创建gauge, 使用默认Client
+ * @param string $metric 指标名称
+ * @param map    $tags   可选的tag
+ *
+ * @return *GaugeHandle
+ */
+func NewGauge(metric string, tags ...map[string]string) *GaugeHandle {
+	return newGauge(nil, metric, copyTags(tags))
+}
+
+func (this *Client) NewGauge(metric string, tags ...map[string]string) *GaugeHandle {
+	return newGauge(this, metric, copyTags(tags))
+}
+
+func newGauge(c *Client, metric string, tags map[string]string) *GaugeHandle {
+	return &GaugeHandle{handle: newHandle(c, func(c *Client, cfg *clientConfig) point {
+		return c.gaugePoint(cfg, metric, 0, []map[string]string{tags})
+	})}
+}
+
+func (this *GaugeHandle) Set(value float64) error {
+	st := this.bind()
+	if st.err != nil {
+		return this.reject(st)
+	}
+	p := st.p
+	p.fval = value
+	return st.push(&p)
+}
+
+// rpc
+type RpcHandle struct {
+	handle
+}
+
+/**
+ * @note
+ * 创建rpc统计, 使用默认Client
+ * @param string $metric 指标名
+ * @param string $caller 主调服务标识
+ * @param string $callee 被调服务标识
+ * @param map    $tags   可选的tag
+ *
+ * @return *RpcHandle
+ */
+func NewRpc(metric string, caller string, callee string, tags ...map[string]string) *RpcHandle {
+	return newRpc(nil, metric, caller, callee, DefaultRpcVersion, copyTags(tags))
+}
+
+// 同 NewRpc, 使用rpce
+func NewRpcE(metric string, caller string, callee string, tags ...map[string]string) *RpcHandle {
+	return newRpc(nil, metric, caller, callee, EnhanceRpcVersion, copyTags(tags))
+}
+
+func (this *Client) NewRpc(metric string, caller string, callee string, tags ...map[string]string) *RpcHandle {
+	return newRpc(this, metric, caller, callee, DefaultRpcVersion, copyTags(tags))
+}
+
+func (this *Client) NewRpcE(metric string, caller string, callee string, tags ...map[string]string) *RpcHandle {
+	return newRpc(this, metric, caller, callee, EnhanceRpcVersion, copyTags(tags))
+}
+
+func newRpc(c *Client, metric string, caller string, callee string, version int, tags map[string]string) *RpcHandle {
+	return &RpcHandle{handle: newHandle(c, func(c *Client, cfg *clientConfig) point {
+		return c.rpcPoint(cfg, metric, caller, callee, 0, "", version, []map[string]string{tags})
+	})}
+}
+
+/**
+ * @note
+ * 上报一次调用
+ * @param duration $latency 调用耗时
+ * @param any      $code    调用结果, 归一化规则见 ClassifyCode
+ *
+ * @return error
+ */
+func (this *RpcHandle) Observe(latency time.Duration, code interface{}) error {
+	st := this.bind()
+	if st.err != nil {
+		return this.reject(st)
+	}
+	p := st.p
+	p.ival = latency.Nanoseconds() / 1000000
+	p.setCode(code, st.client.classifier)
+
+	// code每次不同, 单独处理非法字符
+	var err error
+	p.sval, err = sanitizeValue("value", p.sval, rpcCodeIllegal, st.client.chars)
+	if err != nil {
+		st.client.stats.addInvalid(err)
+		return err
+	}
+	return st.push(&p)
+}
@@ -0,0 +1,134 @@
+package statsdlib
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandles(t *testing.T) {
+	tr := NewMemTransport()
+	c, _ := NewClient(WithTransport(tr), WithNs("ns"))
+	defer c.Close(context.Background())
+
+	tags := map[string]string{"b": "2", "a": "1"}
+	hit := c.NewCounter("hit", tags)
+	tags["a"] = "changed" // 创建后修改tags不影响handle
+	hit.Inc()
+	hit.Add(3)
+	c.NewGauge("mem").Set(1.5)
+	c.NewRpc("rpc", "caller", "/api?id=1", map[string]string{"idc": "bj"}).Observe(12*time.Millisecond, 500)
+
+	want := []string{
+		"1\nns/hit\na=1\nb=2\nc",
+		"3\nns/hit\na=1\nb=2\nc",
+		"1.500000\nns/mem\ng",
+		"12,500\nns/rpc\ncallee=/api\ncaller=caller\nidc=bj\nrpc",
+	}
+	payloads := tr.Payloads()
+	if len(payloads) != len(want) {
+		t.Fatalf("bad payloads: %q", payloads)
+	}
+	for i, w := range want {
+		if string(payloads[i]) != w {
+			t.Errorf("payload %d: got %q, want %q", i, payloads[i], w)
+		}
+	}
+
+	// 与普通接口的编码一致
+	tr.Reset()
+	c.Counter("hit", map[string]string{"a": "1", "b": "2"})
+	if string(tr.Payloads()[0]) != want[0] {
+		t.Errorf("handle and Counter differ: %q", tr.Payloads()[0])
+	}
+}
+
+func TestHandleInvalid(t *testing.T) {
+	tr := NewMemTransport()
+	c, _ := NewClient(WithTransport(tr), WithNs("ns"))
+	defer c.Close(context.Background())
+
+	bad := c.NewCounter("hit", map[string]string{"k": strings.Repeat("v", maxTagvLen+1)})
+	if bad.Err() == nil || bad.Inc() == nil {
+		t.Errorf("expect error for too long tagv")
+	}
+	if len(tr.Payloads()) != 0 {
+		t.Errorf("invalid handle should not send")
+	}
+
+	strict, _ := NewClient(WithTransport(tr), WithNs("ns"), WithCharPolicy(CharStrict))
+	defer strict.Close(context.Background())
+	if err := strict.NewRpc("rpc", "a", "b").Observe(time.Millisecond, "bad\ncode"); err == nil {
+		t.Errorf("expect error for illegal code")
+	}
+}
+
+func TestHandleDefaultClient(t *testing.T) {
+	old := _defaultClient.Load()
+	defer _defaultClient.Store(old)
+
+	tr1, tr2 := NewMemTransport(), NewMemTransport()
+	c1, _ := NewClient(WithTransport(tr1), WithNs("ns1"))
+	c2, _ := NewClient(WithTransport(tr2), WithNs("ns2"))
+	defer c1.Close(context.Background())
+	defer c2.Close(context.Background())
+
+	hit := NewCounter("hit")
+	_defaultClient.Store(c1)
+	hit.Inc()
+	_defaultClient.Store(c2)
+	hit.Inc()
+
+	if p := tr1.Payloads(); len(p) != 1 || string(p[0]) != "1\nns1/hit\nc" {
+		t.Errorf("bad payloads of client 1: %q", p)
+	}
+	if p := tr2.Payloads(); len(p) != 1 || string(p[0]) != "1\nns2/hit\nc" {
+		t.Errorf("bad payloads of client 2: %q", p)
+	}
+}
+
+func TestHandleAllocs(t *testing.T) {
+	skipAllocsUnderRace(t)
+	c := newBenchClient(t)
+	defer c.Close(context.Background())
+	aggr := newBenchClient(t, WithCounterAggregation(time.Hour), WithRpcAggregation(time.Hour))
+	defer aggr.Close(context.Background())
+	tags := map[string]string{"api": "login", "idc": "bj"}
+
+	for _, cl := range []*Client{c, aggr} {
+		hit, mem, rpc := cl.NewCounter("api.hit", tags), cl.NewGauge("mem.used", tags), cl.NewRpc("rpc", "caller", "callee", tags)
+		for name, fn := range map[string]func(){
+			"Counter": func() { hit.Inc() },
+			"Gauge":   func() { mem.Set(1024.5) },
+			"Rpc":     func() { rpc.Observe(12*time.Millisecond, "ok") },
+		} {
+			fn()
+			if allocs := testing.AllocsPerRun(100, fn); allocs != 0 {
+				t.Errorf("%s: %.1f allocs/op", name, allocs)
+			}
+		}
+	}
+}
+
+func BenchmarkCounterHandle(b *testing.B) {
+	c := newBenchClient(b)
+	defer c.Close(context.Background())
+	hit := c.NewCounter("api.hit", map[string]string{"api": "login", "idc": "bj"})
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		hit.Inc()
+	}
+}
+
+func BenchmarkRpcHandle(b *testing.B) {
+	c := newBenchClient(b)
+	defer c.Close(context.Background())
+	rpc := c.NewRpc("rpc", "caller", "callee", map[string]string{"idc": "bj"})
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		rpc.Observe(12*time.Millisecond, "ok")
+	}
+}
@@ -1,31 +1,92 @@
 package statsdlib
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
 )
 
-func init() {
-	err := logger{}.Init()
+// 默认Client, 包级别的接口都通过它上报
+var (
+	_defaultClient atomic.Pointer[Client]
+	_autoInitOnce  sync.Once
+	_autoInitOff   atomic.Bool
+)
+
+// 设置该环境变量为 off 时不自动初始化
+const autoInitEnv = "STATSDLIB_AUTOINIT"
+
+// 设置该环境变量为 on 时, 自动初始化的Client把日志写到 .statsd/statsd.log
+const logFileEnv = "STATSDLIB_LOG_FILE"
+
+/**
+ * @note
+ * 初始化默认Client, 应在程序启动时、上报之前调用
+ * 未调用时, 第一次上报会按旧版行为自动初始化(读取工作目录下的 .statsd/ .deploy/)
+ * @param Config $cfg 配置
+ *
+ * @return error
+ */
+func Init(cfg Config) error {
+	c, err := cfg.newClient()
 	if err != nil {
-		fmt.Println(err.Error())
-		return
+		return err
 	}
 
-	err = statsdServer{}.Init()
-	if err != nil {
-		logger{}.Erro(err.Error())
-		return
+	old := _defaultClient.Swap(c)
+	if old != nil {
+		old.Close(context.Background())
 	}
+	return nil
+}
 
-	err = statsdClient{}.Init()
+// 同 Init, 失败时panic
+func MustInit(cfg Config) {
+	err := Init(cfg)
 	if err != nil {
-		logger{}.Erro(err.Error())
-		return
+		panic(fmt.Sprintf("statsdlib init error: %s", err.Error()))
 	}
+}
 
-	err = serviceMeta{}.Init()
-	if err != nil {
-		logger{}.Erro(fmt.Sprintf("service meta init error: %s", err.Error()))
-		return
+/**
+ * @note
+ * 关闭自动初始化, 之后未调用 Init 时包级别接口都返回错误, 不会读写任何文件
+ * 也可以通过环境变量 STATSDLIB_AUTOINIT=off 关闭
+ *
+ * @return void
+ */
+func DisableAutoInit() {
+	_autoInitOff.Store(true)
+}
+
+func defaultClient() *Client {
+	c := _defaultClient.Load()
+	if c != nil {
+		return c
+	}
+
+	_autoInitOnce.Do(autoInit)
+	return _defaultClient.Load()
+}
+
+// 按旧版行为初始化, 失败时退化为未初始化的Client, 上报时返回错误
+func autoInit() {
+	var c *Client
+	if !_autoInitOff.Load() && os.Getenv(autoInitEnv) != "off" {
+		var err error
+		cfg := legacyConfig
+		cfg.LogFile = os.Getenv(logFileEnv) == "on"
+		c, err = cfg.newClient()
+		if err != nil {
+			// 日志文件可能没有打开, 只能打到标准输出
+			fmt.Println("statsdlib auto init error: " + err.Error())
+			c = nil
+		}
+	}
+	if c == nil {
+		c = &Client{}
 	}
+	_defaultClient.CompareAndSwap(nil, c)
 }
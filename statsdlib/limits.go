@@ -0,0 +1,221 @@
+package statsdlib
+
+import (
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+/***************************************************************************
+ * 长度/个数限制: 按agent的实际限制配置, 超出限制时按LimitPolicy处理
+ *   LimitReject   : 返回错误, 不上报 (默认)
+ *   LimitTruncate : 过长的metric/tagk/tagv截断并加上原值的hash后缀, 保证不同的值截断后仍不同;
+ *                   tag过多时先丢弃context中的tags(见 ctxtags.go), 再按key排序丢弃多出的tag,
+ *                   Client的默认tags(见 SetDefaultTags)占用固定的个数, 不会被丢弃
+ *   LimitDrop     : 丢弃过长或多出的tag, metric过长时仍返回错误
+ * rpc的caller/callee同默认tags占用固定的个数, 不会被丢弃; 过长时不论policy都截断并加上hash后缀
+ * 空的ns/metric/tagk/tagv总是返回错误
+ **************************************************************************/
+
+// 各项长度/个数限制
+type Limits struct {
+	MaxTagkLen   int `json:"max_tagk_len"`
+	MaxTagvLen   int `json:"max_tagv_len"`
+	MaxTagCnt    int `json:"max_tag_cnt"`
+	MaxMetricLen int `json:"max_metric_len"`
+}
+
+var DefaultLimits = Limits{
+	MaxTagkLen:   maxTagkLen,
+	MaxTagvLen:   maxTagvLen,
+	MaxTagCnt:    maxTagCnt,
+	MaxMetricLen: maxMetricLen,
+}
+
+// 未设置(<=0)的项使用 DefaultLimits
+func (this Limits) withDefaults() Limits {
+	if this.MaxTagkLen <= 0 {
+		this.MaxTagkLen = DefaultLimits.MaxTagkLen
+	}
+	if this.MaxTagvLen <= 0 {
+		this.MaxTagvLen = DefaultLimits.MaxTagvLen
+	}
+	if this.MaxTagCnt <= 0 {
+		this.MaxTagCnt = DefaultLimits.MaxTagCnt
+	}
+	if this.MaxMetricLen <= 0 {
+		this.MaxMetricLen = DefaultLimits.MaxMetricLen
+	}
+	return this
+}
+
+// 超出限制时的处理方式
+type LimitPolicy int
+
+const (
+	LimitReject   LimitPolicy = iota // 返回错误, 不上报 (默认)
+	LimitTruncate                    // 截断并加上hash后缀
+	LimitDrop                        // 丢弃超出限制的tag
+)
+
+// 各处理方式触发的次数
+type LimitStats struct {
+	Rejected  uint64 `json:"rejected"`  // 因超出限制返回错误的上报次数
+	Truncated uint64 `json:"truncated"` // 被截断的metric/tagk/tagv个数
+	Dropped   uint64 `json:"dropped"`   // 被丢弃的tag个数
+}
+
+type limitCounters struct {
+	rejected  atomic.Uint64
+	truncated atomic.Uint64
+	dropped   atomic.Uint64
+}
+
+// 一次校验截断和丢弃的个数
+type limitFit struct {
+	truncated int
+	dropped   int
+}
+
+// 计入一次上报的结果, err为超出限制时计入rejected
+func (this *limitCounters) record(fit limitFit, err error) {
+	if fit.truncated > 0 {
+		this.truncated.Add(uint64(fit.truncated))
+	}
+	if fit.dropped > 0 {
+		this.dropped.Add(uint64(fit.dropped))
+	}
+	if err != nil && isLimitErr(err) {
+		this.rejected.Add(1)
+	}
+}
+
+func (this *limitCounters) stats() LimitStats {
+	return LimitStats{
+		Rejected:  this.rejected.Load(),
+		Truncated: this.truncated.Load(),
+		Dropped:   this.dropped.Load(),
+	}
+}
+
+func isLimitErr(err error) bool {
+	return errors.Is(err, ErrMetricTooLong) || errors.Is(err, ErrTooManyTags) ||
+		errors.Is(err, ErrTagkTooLong) || errors.Is(err, ErrTagvTooLong)
+}
+
+// 校验point, 超出限制时按policy截断或丢弃, 不能处理时返回错误
+// 返回截断和丢弃的个数, 由调用方用 limitCounters.record 计数
+func (this *point) checkLimits(limits Limits, policy LimitPolicy) (fit limitFit, err error) {
+	fit.truncated = this.fitRpcTags(limits)
+	err = this.check(limits)
+	if err == nil || !isLimitErr(err) {
+		return fit, err
+	}
+	if policy != LimitReject {
+		truncated, dropped := this.fitLimits(limits, policy)
+		fit.truncated += truncated
+		fit.dropped += dropped
+		err = this.check(limits)
+	}
+	return fit, err
+}
+
+// 过长的caller/callee总是截断, 与policy无关, 返回截断的个数
+func (this *point) fitRpcTags(limits Limits) (truncated int) {
+	if !this.rpcTags {
+		return 0
+	}
+	if _, found := this.tags["caller"]; !found && len(this.caller) > limits.MaxTagvLen {
+		this.caller = truncateHash(this.caller, limits.MaxTagvLen)
+		truncated++
+	}
+	if _, found := this.tags["callee"]; !found && len(this.callee) > limits.MaxTagvLen {
+		this.callee = truncateHash(this.callee, limits.MaxTagvLen)
+		truncated++
+	}
+	return truncated
+}
+
+// 截断或丢弃超出限制的部分, 返回截断和丢弃的个数; tags会复制, 不修改调用方的map
+func (this *point) fitLimits(limits Limits, policy LimitPolicy) (truncated int, dropped int) {
+	if len(this.metric) > limits.MaxMetricLen && policy == LimitTruncate {
+		this.metric = truncateHash(this.metric, limits.MaxMetricLen)
+		truncated++
+	}
+
+	tags := make(map[string]string, this.tagCnt())
+	keys := make([]string, 0, this.tagCnt())
+	ctxKeys := []string{}
+	reserved := 0
+	this.eachTag(func(k string, v string, src tagSource) bool {
+		// caller/callee(包括tags中同名的key)不丢弃, 只截断
+		rpcKey := this.rpcTags && (k == "caller" || k == "callee")
+		if len(k) > limits.MaxTagkLen || len(v) > limits.MaxTagvLen {
+			if policy == LimitDrop && !rpcKey {
+				dropped++
+				return true
+			}
+			if len(k) > limits.MaxTagkLen {
+				k = truncateHash(k, limits.MaxTagkLen)
+				truncated++
+			}
+			if len(v) > limits.MaxTagvLen {
+				v = truncateHash(v, limits.MaxTagvLen)
+				truncated++
+			}
+		}
+		tags[k] = v
+		switch {
+		case rpcKey || src == tagFromDefault:
+			reserved++
+		case src == tagFromCtx:
+			ctxKeys = append(ctxKeys, k)
+		default:
+			keys = append(keys, k)
+		}
+		return true
+	})
+
+	// tag过多时默认tags和caller/callee保留, 先丢弃context中的tags, 再按key排序保留前面的
+	sortStrings(keys)
+	sortStrings(ctxKeys)
+	keys = append(keys, ctxKeys...)
+	if room := limits.MaxTagCnt - reserved; len(keys) > room && room >= 0 {
+		for _, k := range keys[room:] {
+			delete(tags, k)
+			dropped++
+		}
+	}
+
+	this.setTags(tags)
+	return truncated, dropped
+}
+
+const hashSuffixLen = 9 // ~ + 8位16进制
+
+// 截断到不超过max字节, 末尾为原值的fnv-1a hash, 不同的值截断后仍不同
+func truncateHash(s string, max int) string {
+	if max <= hashSuffixLen {
+		return s[:runeBoundary(s, max)]
+	}
+
+	h := uint32(2166136261)
+	for i := 0; i < len(s); i++ {
+		h ^= uint32(s[i])
+		h *= 16777619
+	}
+	suffix := strconv.FormatUint(uint64(h), 16)
+	for len(suffix) < hashSuffixLen-1 {
+		suffix = "0" + suffix
+	}
+	return s[:runeBoundary(s, max-hashSuffixLen)] + "~" + suffix
+}
+
+// 不超过n的最大utf8字符边界, 避免截断出不完整的字符
+func runeBoundary(s string, n int) int {
+	for n > 0 && n < len(s) && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return n
+}
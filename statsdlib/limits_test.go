@@ -0,0 +1,149 @@
+package statsdlib
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLimitPolicy(t *testing.T) {
+	limits := Limits{MaxTagkLen: 16, MaxTagvLen: 16, MaxTagCnt: 3, MaxMetricLen: 16}
+	long := strings.Repeat("v", 20)
+	tags := map[string]string{"a": "1", "b": long, "c": "3", "d": "4"}
+
+	// reject
+	tr := NewMemTransport()
+	c, _ := NewClient(WithTransport(tr), WithNs("ns"), WithLimits(limits))
+	if err := c.Counter("m", tags); !errors.Is(err, ErrTooManyTags) {
+		t.Errorf("reject: unexpected error %v", err)
+	}
+	if err := c.Counter("m", map[string]string{"a": long}); !errors.Is(err, ErrTagvTooLong) {
+		t.Errorf("reject: unexpected error %v", err)
+	}
+	// caller/callee 总是截断
+	if err := c.RpcMetric("rpc", "caller", long, 0, "ok"); err != nil {
+		t.Errorf("reject: callee should be truncated, got %v", err)
+	}
+	if p := tr.Payloads(); len(p) != 1 || string(p[0]) != "0,ok\nns/rpc\ncallee="+truncateHash(long, 16)+"\ncaller=caller\nrpc" {
+		t.Errorf("reject: bad payloads %q", p)
+	}
+	if st := c.LimitStats(); st != (LimitStats{Rejected: 2, Truncated: 1}) {
+		t.Errorf("reject: bad stats %+v", st)
+	}
+	c.Close(context.Background())
+
+	// truncate
+	tr = NewMemTransport()
+	c, _ = NewClient(WithTransport(tr), WithNs("ns"), WithLimits(limits), WithLimitPolicy(LimitTruncate))
+	if err := c.Counter(strings.Repeat("m", 20), tags); err != nil {
+		t.Errorf("truncate: unexpected error %v", err)
+	}
+	m, _ := Decode(tr.Payloads()[0])
+	if len(m.Metric) != 16 || len(m.Tags) != 3 || len(m.Tags["b"]) != 16 || m.Tags["b"] != truncateHash(long, 16) {
+		t.Errorf("truncate: bad metric %+v", m)
+	}
+	if _, found := m.Tags["d"]; found {
+		t.Errorf("truncate: tag d should be dropped: %+v", m.Tags)
+	}
+	if len(tags["b"]) != 20 {
+		t.Errorf("truncate: caller's tags modified")
+	}
+	if st := c.LimitStats(); st != (LimitStats{Truncated: 2, Dropped: 1}) {
+		t.Errorf("truncate: bad stats %+v", st)
+	}
+	c.Close(context.Background())
+
+	// drop
+	tr = NewMemTransport()
+	c, _ = NewClient(WithTransport(tr), WithNs("ns"), WithLimits(limits), WithLimitPolicy(LimitDrop))
+	if err := c.Counter("m", tags); err != nil {
+		t.Errorf("drop: unexpected error %v", err)
+	}
+	if err := c.RpcMetric("rpc", "caller", long, time.Millisecond, "ok"); err != nil {
+		t.Errorf("drop: unexpected error %v", err)
+	}
+	if err := c.Counter(strings.Repeat("m", 20)); !errors.Is(err, ErrMetricTooLong) {
+		t.Errorf("drop: metric too long should be rejected, got %v", err)
+	}
+	payloads := tr.Payloads()
+	if len(payloads) != 2 || string(payloads[0]) != "1\nns/m\na=1\nc=3\nd=4\nc" || string(payloads[1]) != "1,ok\nns/rpc\ncallee="+truncateHash(long, 16)+"\ncaller=caller\nrpc" {
+		t.Errorf("drop: bad payloads %q", payloads)
+	}
+	if st := c.LimitStats(); st != (LimitStats{Rejected: 1, Truncated: 1, Dropped: 1}) {
+		t.Errorf("drop: bad stats %+v", st)
+	}
+	c.Close(context.Background())
+}
+
+// tag过多时caller/callee同默认tags一样保留
+func TestLimitRpcReserved(t *testing.T) {
+	long := strings.Repeat("v", 20)
+	for _, policy := range []LimitPolicy{LimitTruncate, LimitDrop} {
+		tr := NewMemTransport()
+		c, _ := NewClient(WithTransport(tr), WithNs("ns"), WithLimits(Limits{MaxTagCnt: 2, MaxTagvLen: 16}), WithLimitPolicy(policy))
+		if err := c.RpcMetric("m", "x", "y", time.Millisecond, "ok", map[string]string{"a": "1"}); err != nil {
+			t.Errorf("policy %d: unexpected error %v", policy, err)
+		}
+		if err := c.NewRpc("m", long, "y", map[string]string{"a": "1"}).Observe(time.Millisecond, "ok"); err != nil {
+			t.Errorf("policy %d: handle: unexpected error %v", policy, err)
+		}
+		p := tr.Payloads()
+		if len(p) != 2 || string(p[0]) != "1,ok\nns/m\ncallee=y\ncaller=x\nrpc" ||
+			string(p[1]) != "1,ok\nns/m\ncallee=y\ncaller="+truncateHash(long, 16)+"\nrpc" {
+			t.Errorf("policy %d: bad payloads %q", policy, p)
+		}
+		if st := c.LimitStats(); st != (LimitStats{Truncated: 1, Dropped: 2}) {
+			t.Errorf("policy %d: bad stats %+v", policy, st)
+		}
+		c.Close(context.Background())
+	}
+}
+
+// handle只校验一次, 截断和丢弃按上报次数计数
+func TestLimitStatsHandle(t *testing.T) {
+	c, _ := NewClient(WithTransport(NewMemTransport()), WithNs("ns"), WithLimits(Limits{MaxTagCnt: 1}), WithLimitPolicy(LimitTruncate))
+	defer c.Close(context.Background())
+
+	r, _ := NewClient(WithTransport(NewMemTransport()), WithNs("ns"), WithLimits(Limits{MaxTagCnt: 1}))
+	defer r.Close(context.Background())
+
+	tags := map[string]string{"a": "1", "b": "2"}
+	h := c.NewCounter("m", tags)
+	long := c.NewCounter(strings.Repeat("m", maxMetricLen+1))
+	bad := r.NewCounter("m", tags)
+	for i := 0; i < 3; i++ {
+		h.Inc()
+		long.Inc()
+		bad.Inc()
+	}
+	if st := c.LimitStats(); st != (LimitStats{Truncated: 3, Dropped: 3}) {
+		t.Errorf("bad stats %+v", st)
+	}
+	if st := r.LimitStats(); st != (LimitStats{Rejected: 3}) {
+		t.Errorf("bad reject stats %+v", st)
+	}
+}
+
+func TestTruncateHash(t *testing.T) {
+	a, b := truncateHash(strings.Repeat("x", 30)+"a", 20), truncateHash(strings.Repeat("x", 30)+"b", 20)
+	if len(a) != 20 || len(b) != 20 || a == b {
+		t.Errorf("bad truncate: %q %q", a, b)
+	}
+	// 不截断出不完整的utf8字符
+	if s := truncateHash(strings.Repeat("中", 10), 20); len(s) > 20 || !strings.HasPrefix(s, "中中中~") {
+		t.Errorf("bad utf8 truncate: %q", s)
+	}
+	if s := truncateHash("abcdefgh", 4); s != "abcd" {
+		t.Errorf("bad short truncate: %q", s)
+	}
+}
+
+func TestLimitsDefaults(t *testing.T) {
+	c, _ := NewClient(WithTransport(NewMemTransport()), WithLimits(Limits{MaxTagCnt: 2}))
+	defer c.Close(context.Background())
+	if c.Limits() != (Limits{MaxTagkLen: maxTagkLen, MaxTagvLen: maxTagvLen, MaxTagCnt: 2, MaxMetricLen: maxMetricLen}) {
+		t.Errorf("bad limits: %+v", c.Limits())
+	}
+}
@@ -1,53 +1,288 @@
 package statsdlib
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"os"
+	"log/slog"
+	"path/filepath"
 	"strings"
-	"syscall"
+	"sync"
 	"time"
 )
 
-var _loggerFd io.Writer
+/***************************************************************************
+ * 日志: 库内部的诊断信息(连接、flush失败、panic等)通过 Logger 输出,
+ * 默认不输出, 可以接入已有的结构化日志:
+ *   statsd.Init(statsd.Config{Logger: statsd.NewSlogLogger(slog.Default()), LogLevel: statsd.LogWarn})
+ * 写文件需要显式开启, 见 Config.LogFile 和 NewFileLogger
+ * 相同的错误日志在 LogRepeatInterval 内只输出一次, 之后输出时带上重复次数(repeated)
+ **************************************************************************/
 
-type logger struct{}
+// 日志级别, 数值与 log/slog 一致
+type LogLevel int
 
-func (this logger) Init() error {
-	fd, err := this.mkLogFile()
+const (
+	LogDebug LogLevel = -4
+	LogInfo  LogLevel = 0 // 默认
+	LogWarn  LogLevel = 4
+	LogError LogLevel = 8
+	LogOff   LogLevel = 12 // 不输出
+)
+
+func (this LogLevel) String() string {
+	switch this {
+	case LogDebug:
+		return "DEBU"
+	case LogInfo:
+		return "INFO"
+	case LogWarn:
+		return "WARN"
+	case LogError:
+		return "ERRO"
+	case LogOff:
+		return "OFF"
+	}
+	return fmt.Sprintf("LEVEL(%d)", int(this))
+}
+
+// Logger 接收库内部的日志, 需要并发安全
+// attrs 为交替的 key(string)、value, 与 slog.Logger.Log 一致
+type Logger interface {
+	Log(level LogLevel, msg string, attrs ...interface{})
+}
+
+// 不输出任何日志
+func NopLogger() Logger {
+	return nopLogger{}
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(level LogLevel, msg string, attrs ...interface{}) {}
+
+/**
+ * @note
+ * 把日志转给 slog.Logger, 级别按数值对应
+ * @param *slog.Logger $l 为nil时使用 slog.Default()
+ *
+ * @return Logger
+ */
+func NewSlogLogger(l *slog.Logger) Logger {
+	return slogLogger{l: l}
+}
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+func (this slogLogger) Log(level LogLevel, msg string, attrs ...interface{}) {
+	l := this.l
+	if l == nil {
+		l = slog.Default()
+	}
+	l.Log(context.Background(), slog.Level(level), msg, attrs...)
+}
+
+/**
+ * @note
+ * 按行写到w, 格式: 2006-01-02 15:04:05 [INFO] msg k=v
+ * @param io.Writer $w
+ *
+ * @return Logger
+ */
+func NewWriterLogger(w io.Writer) Logger {
+	return &writerLogger{w: w}
+}
+
+type writerLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (this *writerLogger) Log(level LogLevel, msg string, attrs ...interface{}) {
+	line := formatLog(time.Now(), level, msg, attrs)
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	io.WriteString(this.w, line)
+}
+
+func formatLog(now time.Time, level LogLevel, msg string, attrs []interface{}) string {
+	var sb strings.Builder
+	sb.WriteString(now.Format("2006-01-02 15:04:05"))
+	sb.WriteString(" [")
+	sb.WriteString(level.String())
+	sb.WriteString("] ")
+	sb.WriteString(strings.TrimSuffix(msg, "\n"))
+	for i := 0; i < len(attrs); i += 2 {
+		if i+1 == len(attrs) {
+			fmt.Fprintf(&sb, " !BADKEY=%v", attrs[i])
+			break
+		}
+		fmt.Fprintf(&sb, " %v=%v", attrs[i], attrs[i+1])
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
+
+// 写文件的Logger, 目录不存在时创建, 文件权限0644, 按 LogRotate 切分
+type FileLogger struct {
+	writerLogger
+	f *rotateFile
+}
+
+/**
+ * @note
+ * 打开(追加)日志文件
+ * @param string    $path   文件路径
+ * @param LogRotate $rotate 切分和清理规则, 零值表示不切分
+ *
+ * @return *FileLogger, error
+ */
+func NewFileLogger(path string, rotate LogRotate) (*FileLogger, error) {
+	f, err := openRotateFile(path, rotate)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return &FileLogger{writerLogger: writerLogger{w: f}, f: f}, nil
+}
 
-	_loggerFd = fd
-	return nil
+func (this *FileLogger) Close() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.f.Close()
 }
 
-func (this logger) Info(format string, args ...interface{}) {
-	if !strings.HasSuffix(format, "\n") {
-		format += "\n"
+// 旧版的日志文件: WorkDir/.statsd/statsd.log
+func legacyLogFile(wd string) string {
+	return filepath.Join(wd, ".statsd", "statsd.log")
+}
+
+// 内部使用, 按级别过滤; l 为空时不输出
+type logger struct {
+	l       Logger
+	level   LogLevel
+	limiter *logLimiter // 为空时不限制
+}
+
+func (this logger) Debug(msg string, attrs ...interface{}) {
+	this.log(LogDebug, msg, attrs)
+}
+
+func (this logger) Info(msg string, attrs ...interface{}) {
+	this.log(LogInfo, msg, attrs)
+}
+
+func (this logger) Warn(msg string, attrs ...interface{}) {
+	this.log(LogWarn, msg, attrs)
+}
+
+func (this logger) Erro(msg string, attrs ...interface{}) {
+	this.log(LogError, msg, attrs)
+}
+
+func (this logger) log(level LogLevel, msg string, attrs []interface{}) {
+	if this.l == nil || level < this.level || this.level >= LogOff {
+		return
 	}
-	fmt.Fprintf(_loggerFd, this.now()+" [INFO] "+format, args...)
+	// Warn及以上的日志限频
+	if this.limiter != nil && level >= LogWarn {
+		emit, repeated := this.limiter.allow(level, msg, attrs)
+		if !emit {
+			return
+		}
+		if repeated > 0 {
+			attrs = append(attrs[:len(attrs):len(attrs)], "repeated", repeated)
+		}
+	}
+	this.l.Log(level, msg, attrs...)
 }
 
-func (this logger) Erro(format string, args ...interface{}) {
-	if !strings.HasSuffix(format, "\n") {
-		format += "\n"
+// 输出被限频的日志的重复次数
+func (this logger) flush() {
+	if this.l == nil || this.limiter == nil {
+		return
+	}
+	for _, e := range this.limiter.flush() {
+		attrs := append(e.attrs[:len(e.attrs):len(e.attrs)], "repeated", e.suppressed)
+		this.l.Log(e.level, e.msg, attrs...)
 	}
-	fmt.Fprintf(_loggerFd, this.now()+" [ERRO] "+format, args...)
 }
 
-func (this logger) mkLogFile() (io.Writer, error) {
-	wd, _ := syscall.Getwd()
+// 相同的日志(msg和attrs都相同)每interval只输出一次, 期间的重复次数在下一次输出时带上
+type logLimiter struct {
+	interval time.Duration
+	now      func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*logRepeat
+}
+
+type logRepeat struct {
+	level      LogLevel
+	msg        string
+	attrs      []interface{}
+	last       time.Time // 上次输出的时间
+	suppressed int       // 上次输出之后被限频的次数
+}
+
+// 限频的日志种类上限, 超出时不限频
+const maxLogRepeatKeys = 1024
 
-	logdir := wd + "/.statsd"
-	os.MkdirAll(logdir, 0777)
+// 默认的限频间隔, 见 WithLogRepeatInterval
+const DefaultLogRepeatInterval = time.Minute
 
-	logfn := logdir + "/statsd.log"
-	f, err := os.OpenFile(logfn, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0777)
-	return f, err
+func newLogLimiter(interval time.Duration) *logLimiter {
+	return &logLimiter{interval: interval, now: time.Now, entries: map[string]*logRepeat{}}
 }
 
-func (this logger) now() string {
-	return string(time.Now().Format("2006-01-02 15:04:05"))
+// 是否输出, 以及上次输出之后被限频的次数
+func (this *logLimiter) allow(level LogLevel, msg string, attrs []interface{}) (bool, int) {
+	key := fmt.Sprintf("%d %s %v", level, msg, attrs)
+	now := this.now()
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	e := this.entries[key]
+	if e == nil {
+		if len(this.entries) >= maxLogRepeatKeys {
+			this.prune(now)
+		}
+		if len(this.entries) < maxLogRepeatKeys {
+			this.entries[key] = &logRepeat{level: level, msg: msg, attrs: attrs, last: now}
+		}
+		return true, 0
+	}
+	if now.Sub(e.last) < this.interval {
+		e.suppressed++
+		return false, 0
+	}
+	repeated := e.suppressed
+	e.last, e.suppressed = now, 0
+	return true, repeated
+}
+
+// 删除已经过了限频间隔、没有待输出次数的记录
+func (this *logLimiter) prune(now time.Time) {
+	for key, e := range this.entries {
+		if e.suppressed == 0 && now.Sub(e.last) >= this.interval {
+			delete(this.entries, key)
+		}
+	}
+}
+
+// 取出所有待输出的重复次数并清零
+func (this *logLimiter) flush() []logRepeat {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var pending []logRepeat
+	for _, e := range this.entries {
+		if e.suppressed > 0 {
+			pending = append(pending, *e)
+			e.suppressed = 0
+		}
+	}
+	return pending
 }
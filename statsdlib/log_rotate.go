@@ -0,0 +1,245 @@
+package statsdlib
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/***************************************************************************
+ * 日志文件切分: 文件超过 MaxSize 时改名为 <path>.<时间戳> 并重新打开,
+ * 旧文件可以gzip压缩, 超过 MaxBackups 个或者 MaxAge 的旧文件被删除
+ * 压缩和删除在后台进行, 不阻塞写日志
+ **************************************************************************/
+
+// 日志文件的切分和清理, 零值表示不切分
+type LogRotate struct {
+	MaxSize    int64         `json:"max_size"`    // 单个文件的最大字节数, <=0 时不切分
+	MaxBackups int           `json:"max_backups"` // 保留的旧文件个数, <=0 时不限制
+	MaxAge     time.Duration `json:"max_age"`     // 旧文件的保留时间, <=0 时不限制
+	Compress   bool          `json:"compress"`    // gzip压缩旧文件
+}
+
+// Config.LogFile 未设置 LogRotate 时使用
+var DefaultLogRotate = LogRotate{MaxSize: 100 << 20, MaxBackups: 5}
+
+const backupTimeFormat = "20060102-150405.000"
+
+// 按 LogRotate 切分的文件, 写入由调用方加锁
+type rotateFile struct {
+	path   string
+	rotate LogRotate
+	f      *os.File
+	size   int64
+
+	millMu sync.Mutex // 压缩和清理互斥
+	millWg sync.WaitGroup
+}
+
+func openRotateFile(path string, rotate LogRotate) (*rotateFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	this := &rotateFile{path: path, rotate: rotate}
+	if err := this.open(); err != nil {
+		return nil, err
+	}
+	// 清理上次运行留下的旧文件
+	if rotate != (LogRotate{}) {
+		this.goMill()
+	}
+	return this, nil
+}
+
+func (this *rotateFile) open() error {
+	f, err := os.OpenFile(this.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	this.f, this.size = f, st.Size()
+	return nil
+}
+
+func (this *rotateFile) Write(b []byte) (int, error) {
+	if this.f == nil {
+		return 0, fmt.Errorf("log file closed")
+	}
+	if this.rotate.MaxSize > 0 && this.size > 0 && this.size+int64(len(b)) > this.rotate.MaxSize {
+		// 切分失败时尽量继续写原文件
+		if err := this.rotateNow(); err != nil && this.f == nil {
+			return 0, err
+		}
+	}
+	n, err := this.f.Write(b)
+	this.size += int64(n)
+	return n, err
+}
+
+// 当前文件改名为旧文件, 打开新文件, 后台压缩和清理
+func (this *rotateFile) rotateNow() error {
+	if err := this.f.Close(); err != nil {
+		return err
+	}
+	this.f = nil
+
+	backup := this.backupName(time.Now())
+	if err := os.Rename(this.path, backup); err != nil {
+		// 改名失败时继续写原文件
+		if err2 := this.open(); err2 != nil {
+			return err2
+		}
+		return err
+	}
+	if err := this.open(); err != nil {
+		return err
+	}
+
+	this.goMill()
+	return nil
+}
+
+func (this *rotateFile) goMill() {
+	this.millWg.Add(1)
+	go func() {
+		defer this.millWg.Done()
+		this.mill()
+	}()
+}
+
+// <path>.<时间戳>, 同一毫秒内多次切分时加序号
+func (this *rotateFile) backupName(now time.Time) string {
+	name := this.path + "." + now.Format(backupTimeFormat)
+	for i := 1; ; i++ {
+		_, err1 := os.Stat(name)
+		_, err2 := os.Stat(name + ".gz")
+		if os.IsNotExist(err1) && os.IsNotExist(err2) {
+			return name
+		}
+		name = fmt.Sprintf("%s.%s-%d", this.path, now.Format(backupTimeFormat), i)
+	}
+}
+
+type backupFile struct {
+	path    string
+	stamp   string
+	modTime time.Time
+}
+
+// 旧文件, 按切分时间从新到旧排序
+func (this *rotateFile) backups() ([]backupFile, error) {
+	entries, err := os.ReadDir(filepath.Dir(this.path))
+	if err != nil {
+		return nil, err
+	}
+	prefix := filepath.Base(this.path) + "."
+	var files []backupFile
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasPrefix(e.Name(), prefix) {
+			continue
+		}
+		stamp := strings.TrimSuffix(strings.TrimPrefix(e.Name(), prefix), ".gz")
+		if len(stamp) < len(backupTimeFormat) {
+			continue
+		}
+		if _, err := time.Parse(backupTimeFormat, stamp[:len(backupTimeFormat)]); err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, backupFile{path: filepath.Join(filepath.Dir(this.path), e.Name()), stamp: stamp, modTime: info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].stamp > files[j].stamp
+	})
+	return files, nil
+}
+
+// 压缩和删除旧文件
+func (this *rotateFile) mill() error {
+	this.millMu.Lock()
+	defer this.millMu.Unlock()
+
+	files, err := this.backups()
+	if err != nil {
+		return err
+	}
+	var keep []backupFile
+	for i, f := range files {
+		expired := this.rotate.MaxAge > 0 && time.Since(f.modTime) > this.rotate.MaxAge
+		if (this.rotate.MaxBackups > 0 && i >= this.rotate.MaxBackups) || expired {
+			os.Remove(f.path)
+			continue
+		}
+		keep = append(keep, f)
+	}
+	if !this.rotate.Compress {
+		return nil
+	}
+	for _, f := range keep {
+		if strings.HasSuffix(f.path, ".gz") {
+			continue
+		}
+		if err2 := gzipFile(f.path); err2 != nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+// 压缩为 <path>.gz, 成功后删除原文件
+func gzipFile(path string) (err error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(path + ".gz")
+		}
+	}()
+
+	zw := gzip.NewWriter(dst)
+	if _, err = io.Copy(zw, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err = zw.Close(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err = dst.Close(); err != nil {
+		return err
+	}
+	src.Close()
+	return os.Remove(path)
+}
+
+// 关闭文件, 等待后台的压缩和清理结束
+func (this *rotateFile) Close() error {
+	var err error
+	if this.f != nil {
+		err = this.f.Close()
+		this.f = nil
+	}
+	this.millWg.Wait()
+	return err
+}
@@ -0,0 +1,97 @@
+package statsdlib
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func listDir(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("read dir error: %s", err.Error())
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestFileLoggerRotate(t *testing.T) {
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "statsd.log")
+	lg, err := NewFileLogger(fn, LogRotate{MaxSize: 100, MaxBackups: 2})
+	if err != nil {
+		t.Fatalf("new file logger error: %s", err.Error())
+	}
+	msg := strings.Repeat("x", 40) // 一行约70字节, 每行切分一次
+	for i := 0; i < 5; i++ {
+		lg.Log(LogInfo, msg)
+	}
+	lg.Close()
+
+	names := listDir(t, dir)
+	if len(names) != 3 || names[0] != "statsd.log" {
+		t.Fatalf("expect current file and 2 backups, got %v", names)
+	}
+	for _, name := range names {
+		st, _ := os.Stat(filepath.Join(dir, name))
+		if st.Size() > 100 {
+			t.Errorf("%s too large: %d", name, st.Size())
+		}
+	}
+}
+
+func TestFileLoggerCompress(t *testing.T) {
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "statsd.log")
+	lg, _ := NewFileLogger(fn, LogRotate{MaxSize: 100, Compress: true})
+	lg.Log(LogInfo, "first")
+	lg.Log(LogInfo, strings.Repeat("x", 80))
+	lg.Close()
+
+	names := listDir(t, dir)
+	if len(names) != 2 || !strings.HasSuffix(names[1], ".gz") {
+		t.Fatalf("expect a gzipped backup, got %v", names)
+	}
+	f, _ := os.Open(filepath.Join(dir, names[1]))
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("bad gzip: %s", err.Error())
+	}
+	content, _ := io.ReadAll(zr)
+	if !strings.HasSuffix(string(content), "[INFO] first\n") {
+		t.Errorf("bad backup content: %q", content)
+	}
+}
+
+func TestFileLoggerMaxAge(t *testing.T) {
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "statsd.log")
+	old := fn + "." + time.Now().Add(-48*time.Hour).Format(backupTimeFormat)
+	recent := fn + "." + time.Now().Add(-time.Hour).Format(backupTimeFormat) + ".gz"
+	other := filepath.Join(dir, "statsd.log.keep")
+	for _, name := range []string{old, recent, other} {
+		os.WriteFile(name, []byte("x"), 0644)
+	}
+	os.Chtimes(old, time.Now().Add(-48*time.Hour), time.Now().Add(-48*time.Hour))
+
+	// 打开时清理上次运行留下的旧文件
+	lg, _ := NewFileLogger(fn, LogRotate{MaxAge: 24 * time.Hour})
+	lg.Close()
+
+	names := listDir(t, dir)
+	want := []string{"statsd.log", filepath.Base(recent), "statsd.log.keep"}
+	sort.Strings(want)
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Errorf("bad files after cleanup: %v, want %v", names, want)
+	}
+}
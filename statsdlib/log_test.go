@@ -0,0 +1,152 @@
+package statsdlib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type recordLogger struct {
+	lines []string
+}
+
+func (this *recordLogger) Log(level LogLevel, msg string, attrs ...interface{}) {
+	this.lines = append(this.lines, formatLog(time.Time{}, level, msg, attrs)[20:])
+}
+
+func TestLoggerLevel(t *testing.T) {
+	rec := &recordLogger{}
+	lg := logger{l: rec, level: LogWarn}
+	lg.Debug("debug")
+	lg.Info("info")
+	lg.Warn("warn", "k", 1)
+	lg.Erro("error", "err", errors.New("boom"), "odd")
+
+	want := []string{"[WARN] warn k=1\n", "[ERRO] error err=boom !BADKEY=odd\n"}
+	if strings.Join(rec.lines, "") != strings.Join(want, "") {
+		t.Errorf("bad lines: %q", rec.lines)
+	}
+
+	rec.lines = nil
+	logger{l: rec, level: LogOff}.Erro("error")
+	logger{}.Erro("no logger")
+	if len(rec.lines) != 0 {
+		t.Errorf("expect no output: %q", rec.lines)
+	}
+}
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	h := slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	c, _ := NewClient(WithTransport(NewMemTransport()), WithLogger(NewSlogLogger(slog.New(h))), WithLogLevel(LogDebug))
+	c.Close(context.Background())
+
+	if got := buf.String(); got != "level=INFO msg=\"metric transport ready\" addr=\"\"\n" {
+		t.Errorf("bad slog output: %q", got)
+	}
+}
+
+func TestNopLogger(t *testing.T) {
+	c, err := NewClient(WithTransport(NewMemTransport()), WithLogger(NopLogger()))
+	if err != nil {
+		t.Fatalf("new client error: %s", err.Error())
+	}
+	c.Close(context.Background())
+}
+
+func TestLogFile(t *testing.T) {
+	wd := t.TempDir()
+	c, err := Config{Transport: NewMemTransport(), Ns: "ns", WorkDir: wd, LogFile: true}.newClient()
+	if err != nil {
+		t.Fatalf("new client error: %s", err.Error())
+	}
+	c.Close(context.Background())
+
+	fn := filepath.Join(wd, ".statsd", "statsd.log")
+	st, err := os.Stat(fn)
+	if err != nil {
+		t.Fatalf("log file not created: %s", err.Error())
+	}
+	if perm := st.Mode().Perm(); perm&^0644 != 0 {
+		t.Errorf("bad log file mode: %s", perm)
+	}
+	content, _ := os.ReadFile(fn)
+	if !strings.Contains(string(content), "[INFO] metric transport ready") {
+		t.Errorf("bad log content: %q", content)
+	}
+
+	// 没有开启时不写文件
+	wd = t.TempDir()
+	c, _ = Config{Transport: NewMemTransport(), Ns: "ns", WorkDir: wd}.newClient()
+	c.Close(context.Background())
+	if _, err := os.Stat(filepath.Join(wd, ".statsd")); err == nil {
+		t.Errorf("log dir should not be created")
+	}
+}
+
+func TestLogRepeat(t *testing.T) {
+	rec := &recordLogger{}
+	now := time.Unix(0, 0)
+	limiter := newLogLimiter(time.Minute)
+	limiter.now = func() time.Time { return now }
+	lg := logger{l: rec, limiter: limiter}
+
+	for i := 0; i < 5; i++ {
+		lg.Erro("send error", "err", "connection refused")
+	}
+	lg.Erro("send error", "err", "timeout")
+	lg.Info("info is not limited")
+	lg.Info("info is not limited")
+
+	now = now.Add(time.Minute)
+	lg.Erro("send error", "err", "connection refused")
+	lg.Erro("send error", "err", "connection refused")
+	lg.flush()
+	lg.flush()
+
+	want := []string{
+		"[ERRO] send error err=connection refused\n",
+		"[ERRO] send error err=timeout\n",
+		"[INFO] info is not limited\n",
+		"[INFO] info is not limited\n",
+		"[ERRO] send error err=connection refused repeated=4\n",
+		"[ERRO] send error err=connection refused repeated=1\n",
+	}
+	if strings.Join(rec.lines, "") != strings.Join(want, "") {
+		t.Errorf("bad lines: %q", rec.lines)
+	}
+}
+
+func TestClientLogRepeat(t *testing.T) {
+	var buf bytes.Buffer
+	c, _ := NewClient(WithTransport(NewMemTransport()), WithLogWriter(&buf), WithLogLevel(LogError))
+	for i := 0; i < 3; i++ {
+		panicPush(c)
+	}
+	c.Close(context.Background())
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], "[ERRO] metrics push panic panic=boom") || !strings.HasSuffix(lines[1], "panic=boom repeated=2") {
+		t.Errorf("bad log: %q", buf.String())
+	}
+}
+
+// 模拟上报时panic
+func panicPush(c *Client) (err error) {
+	defer c.recoverPanic(&err)
+	panic("boom")
+}
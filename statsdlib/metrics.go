@@ -1,8 +1,8 @@
 package statsdlib
 
 import (
+	"errors"
 	"fmt"
-	"strings"
 	"time"
 )
 
@@ -27,14 +27,13 @@ const (
  * @param string   $caller  主调服务标识
  * @param string   $callee  被掉服务标识
  * @param duration $latency 调用耗时
- * @param string   $code    调用结果,  取值 "ok" "0" "200" "201" "203"为成功、其他均为失败
+ * @param any      $code    调用结果, 支持string、整数、error等, 归一化规则见 ClassifyCode
  * @param map      $tags    可选的tag, 最多只能有4个
  *
  * @return error
  */
 func RpcMetric(metric string, caller string, callee string, latency time.Duration, code interface{}, tags ...map[string]string) error {
-	rb := RpcMetricBuilder(metric, caller, callee, latency, code, DefaultRpcVersion, tags...)
-	return rb.Push()
+	return defaultClient().RpcMetric(metric, caller, callee, latency, code, tags...)
 }
 
 /**
@@ -49,8 +48,7 @@ func Counter(metric string, tags ...map[string]string) error {
 	return CounterN(metric, 1, tags...)
 }
 func CounterN(metric string, cnt int, tags ...map[string]string) error {
-	cb := CounterNBuilder(metric, cnt, tags...)
-	return cb.Push()
+	return defaultClient().CounterN(metric, cnt, tags...)
 }
 
 /**
@@ -62,8 +60,7 @@ func CounterN(metric string, cnt int, tags ...map[string]string) error {
  * @return error
  */
 func Gauge(metric string, value float64, tags ...map[string]string) error {
-	gb := GaugeBuilder(metric, value, tags...)
-	return gb.Push()
+	return defaultClient().Gauge(metric, value, tags...)
 }
 
 /**
@@ -75,8 +72,7 @@ func Gauge(metric string, value float64, tags ...map[string]string) error {
  * @return error
  */
 func Ratio(metric string, code string) error {
-	rb := RatioBuilder(metric, code)
-	return rb.Push()
+	return defaultClient().Ratio(metric, code)
 }
 
 /**
@@ -88,8 +84,7 @@ func Ratio(metric string, code string) error {
  * @return error
  */
 func RatioN(metric string, code string, cnt int) error {
-	rb := RatioBuilder(metric, code, cnt)
-	return rb.Push()
+	return defaultClient().RatioN(metric, code, cnt)
 }
 
 /**
@@ -103,11 +98,7 @@ func RatioN(metric string, code string, cnt int) error {
  * @return error
  */
 func Percentile(metric string, value float64, percentiles []string, tags ...map[string]string) error {
-	if len(percentiles) == 0 {
-		return fmt.Errorf("percentile not defined")
-	}
-	pb := PercentileBuilder(metric, value, percentiles, tags...)
-	return pb.Push()
+	return defaultClient().Percentile(metric, value, percentiles, tags...)
 }
 
 /***************************************************************************
@@ -126,8 +117,7 @@ func CounterE(metric string, tags ...map[string]string) error {
 	return CounterNE(metric, 1, tags...)
 }
 func CounterNE(metric string, cnt int, tags ...map[string]string) error {
-	cb := CounterNEBuilder(metric, cnt, tags...)
-	return cb.Push()
+	return defaultClient().CounterNE(metric, cnt, tags...)
 }
 
 /**
@@ -137,14 +127,13 @@ func CounterNE(metric string, cnt int, tags ...map[string]string) error {
  * @param string   $caller  主调服务标识
  * @param string   $callee  被掉服务标识
  * @param duration $latency 调用耗时
- * @param string   $code    调用结果,  取值 "ok" "0" "200" "201" "203"为成功、其他均为失败
+ * @param any      $code    调用结果, 支持string、整数、error等, 归一化规则见 ClassifyCode
  * @param map      $tags    可选的tag, 最多只能有4个
  *
  * @return error
  */
 func RpcMetricE(metric string, caller string, callee string, latency time.Duration, code interface{}, tags ...map[string]string) error {
-	rb := RpcMetricBuilder(metric, caller, callee, latency, code, EnhanceRpcVersion, tags...)
-	return rb.Push()
+	return defaultClient().RpcMetricE(metric, caller, callee, latency, code, tags...)
 }
 
 /***************************************************************************
@@ -156,14 +145,13 @@ func RpcMetricE(metric string, caller string, callee string, latency time.Durati
  * @param string   $caller  主调服务标识
  * @param string   $callee  被掉服务标识
  * @param duration $latency 调用耗时
- * @param string   $code    调用结果,  取值 "ok" "0" "200" "201" "203"为成功、其他均为失败
+ * @param any      $code    调用结果, 支持string、整数、error等, 归一化规则见 ClassifyCode
  * @param map      $tags    可选的tag, 最多只能有4个
  *
  * @return error
  */
 func Rpc(caller string, callee string, latency time.Duration, code interface{}, tags ...map[string]string) error {
-	rb := RpcBuilder(caller, callee, latency, code, tags...)
-	return rb.Push()
+	return defaultClient().Rpc(caller, callee, latency, code, tags...)
 }
 
 /**
@@ -172,14 +160,13 @@ func Rpc(caller string, callee string, latency time.Duration, code interface{},
  * @param string   $caller  主调服务标识
  * @param string   $callee  被掉服务标识
  * @param duration $latency 调用耗时
- * @param string   $code    调用结果,  取值 "ok" "0" "200" "201" "203"为成功、其他均为失败
+ * @param any      $code    调用结果, 支持string、整数、error等, 归一化规则见 ClassifyCode
  * @param map      $tags    可选的tag, 最多只能有4个
  *
  * @return error
  */
 func RpcE(caller string, callee string, latency time.Duration, code interface{}, tags ...map[string]string) error {
-	rb := RpcEBuilder(caller, callee, latency, code, tags...)
-	return rb.Push()
+	return defaultClient().RpcE(caller, callee, latency, code, tags...)
 }
 
 /***************************************************************************
@@ -189,13 +176,18 @@ func RpcE(caller string, callee string, latency time.Duration, code interface{},
 
 /**
 * @note
-* 设置default nid, 只能在初始化时调用(如非必要,请勿调用!)
-* @param string $nid
+* 设置默认Client的namespace, 可以在运行时调用, 对之后的上报(包括已经创建的handle)生效
+* @param string $ns
 *
 * @return void
  */
 func SetDefaultNs(ns string) {
-	_serviceMeta.Ns = ns
+	defaultClient().SetNs(ns)
+}
+
+// 默认Client, 包级别的接口都通过它上报
+func DefaultClient() *Client {
+	return defaultClient()
 }
 
 func RpcBuilder(caller string, callee string, latency time.Duration, code interface{}, tags ...map[string]string) *metricBuilder {
@@ -207,74 +199,27 @@ func RpcEBuilder(caller string, callee string, latency time.Duration, code inter
 }
 
 func RpcMetricBuilder(metric string, caller string, callee string, latency time.Duration, code interface{}, version int, tags ...map[string]string) *metricBuilder {
-	pos := strings.Index(caller, "?")
-	if pos > 0 {
-		caller = caller[:pos]
-	}
-	if len(caller) > maxTagkLen {
-		caller = caller[:maxTagkLen]
-	}
-
-	pos = strings.Index(callee, "?")
-	if pos > 0 {
-		callee = callee[:pos]
-	}
-	if len(callee) > maxTagkLen {
-		callee = callee[:maxTagkLen]
-	}
-
-	aggr := "rpc"
-	if version == EnhanceRpcVersion {
-		aggr = "rpce"
-	}
-	rb := metricBuilder{}.Name(metric).Ns(_serviceMeta.Ns).Tag("caller", caller).Tag("callee", callee).Agg(
-		fmt.Sprintf("%v,%v", latency.Nanoseconds()/1000000, code), aggr)
-	if len(tags) > 0 {
-		rb.AddTags(tags[0])
-	}
-
-	return rb
+	return defaultClient().rpcMetricBuilder(metric, caller, callee, latency, code, version, tags...)
 }
 
 func CounterNBuilder(metric string, cnt int, tags ...map[string]string) *metricBuilder {
-	cb := metricBuilder{}.Name(metric).Ns(_serviceMeta.Ns).Agg(fmt.Sprintf("%d", cnt), "c")
-	if len(tags) > 0 {
-		cb.AddTags(tags[0])
-	}
-	return cb
+	return defaultClient().counterNBuilder(metric, cnt, tags...)
 }
 
 func CounterNEBuilder(metric string, cnt int, tags ...map[string]string) *metricBuilder {
-	cb := metricBuilder{}.Name(metric).Ns(_serviceMeta.Ns).Agg(fmt.Sprintf("%d", cnt), "ce")
-	if len(tags) > 0 {
-		cb.AddTags(tags[0])
-	}
-	return cb
+	return defaultClient().counterNEBuilder(metric, cnt, tags...)
 }
 
 func GaugeBuilder(metric string, value float64, tags ...map[string]string) *metricBuilder {
-	gb := metricBuilder{}.Name(metric).Ns(_serviceMeta.Ns).Agg(fmt.Sprintf("%f", value), "g")
-	if len(tags) > 0 {
-		gb.AddTags(tags[0])
-	}
-	return gb
+	return defaultClient().gaugeBuilder(metric, value, tags...)
 }
 
 func RatioBuilder(metric string, code string, cnt ...int) *metricBuilder {
-	if len(cnt) == 1 {
-		return metricBuilder{}.Name(metric).Ns(_serviceMeta.Ns).Agg(fmt.Sprintf("%d,%s", cnt[0], code), "rt")
-	}
-
-	return metricBuilder{}.Name(metric).Ns(_serviceMeta.Ns).Agg(code, "rt")
+	return defaultClient().ratioBuilder(metric, code, cnt...)
 }
 
 func PercentileBuilder(metric string, value float64, percentiles []string, tags ...map[string]string) *metricBuilder {
-	aggr := strings.Join(percentiles, ",")
-	pb := metricBuilder{}.Name(metric).Ns(_serviceMeta.Ns).Agg(fmt.Sprintf("%f", value), aggr)
-	if len(tags) > 0 {
-		pb.AddTags(tags[0])
-	}
-	return pb
+	return defaultClient().percentileBuilder(metric, value, percentiles, tags...)
 }
 
 // builder
@@ -285,6 +230,8 @@ type metricBuilder struct {
 	Aggregator  string
 	Tags        map[string]string
 	Value       string
+
+	client *Client
 }
 
 func (this metricBuilder) Name(metric string) *metricBuilder {
@@ -322,84 +269,100 @@ func (self *metricBuilder) Agg(value string, aggregator string) *metricBuilder {
 	return self
 }
 
+// 遇到第一个错误就返回; ns为空时上报仍按原来的方式发送/metric, 只在这里报错
 func (self *metricBuilder) Check() error {
-
-	// check metric
-	metricLen := len(self.Metric)
-	if metricLen == 0 {
-		return fmt.Errorf("empty metric")
-	}
-	if metricLen > maxMetricLen {
-		return fmt.Errorf("metric too long: %s", self.Metric)
+	p := self.point()
+	if len(p.ns) == 0 {
+		return ErrEmptyNs
 	}
+	return p.check(self.pushClient().config().limits)
+}
 
-	// check tags
-	tagCnt := len(self.Tags)
-	if tagCnt > maxTagCnt {
-		return fmt.Errorf("too many tags")
+// 返回所有错误, 多个错误时用 errors.Join 合并
+func (self *metricBuilder) CheckAll() error {
+	p := self.point()
+	err := p.validate(self.pushClient().config().limits, true)
+	if len(p.ns) == 0 {
+		return errors.Join(ErrEmptyNs, err)
 	}
-	if tagCnt != 0 {
-		for k, v := range self.Tags {
-			ksize := len(k)
-			if ksize == 0 {
-				return fmt.Errorf("empty tagk")
-			}
-			if ksize > maxTagkLen {
-				return fmt.Errorf("tagk too long: %s", k)
-			}
-
-			vsize := len(v)
-			if vsize == 0 {
-				return fmt.Errorf("empty tagv")
-			}
-			if vsize > maxTagvLen {
-				return fmt.Errorf("tagv too long: %s", v)
-			}
-		}
-	}
-
-	return nil
+	return err
 }
 
+// tags按key排序, 同一序列的编码逐字节相同
 func (self *metricBuilder) Build() string {
-	lines := []string{self.Value}                                        // value
 	self.NsAndMetric = fmt.Sprintf("%s/%s", self.Namespace, self.Metric) // ns/metric
-	lines = append(lines, self.NsAndMetric)
-	for k, v := range self.Tags {
-		lines = append(lines, fmt.Sprintf("%v=%v", k, v)) // tags
-	}
-	lines = append(lines, self.Aggregator) // aggregator
-	return strings.Join(lines, "\n")
+	p := self.point()
+	return string(p.appendRecord(nil))
 }
 
-func (self *metricBuilder) Push() error {
-	defer func() {
-		if r := recover(); r != nil {
-			logger{}.Erro("metrics push panic: %v\n", r)
-		}
-	}()
-	// check
-	err := self.Check()
-	if err != nil {
-		return err
+func (self *metricBuilder) SeriesKey() SeriesKey {
+	return NewSeriesKey(self.Namespace, self.Metric, self.Tags)
+}
+
+// 转成point编码, value和aggregator原样使用
+func (self *metricBuilder) point() point {
+	return point{
+		ns:         self.Namespace,
+		metric:     self.Metric,
+		aggregator: self.Aggregator,
+		tags:       self.Tags,
+		kind:       valueRaw,
+		sval:       self.Value,
 	}
+}
+
+// 遇到第一个错误就返回
+func (this *point) check(limits Limits) error {
+	return this.validate(limits, false)
+}
 
-	// build
-	body := self.Build()
+// all为true时返回所有错误
+func (this *point) validate(limits Limits, all bool) error {
+	ec := errCollector{all: all}
 
-	// send
-	server := _statsdServer.UdpAddr
-	client := _statsdClient.UdpConn
-	if server == nil {
-		return fmt.Errorf("server not init")
+	// check metric
+	metricLen := len(this.metric)
+	if metricLen == 0 && !ec.add(ErrEmptyMetric) {
+		return ec.err()
 	}
-	if client == nil {
-		return fmt.Errorf("client not init")
+	if metricLen > limits.MaxMetricLen && !ec.add(fmt.Errorf("%w: %s", ErrMetricTooLong, this.metric)) {
+		return ec.err()
 	}
-	_, _, err = client.WriteMsgUDP([]byte(body), nil, server)
-	if nil != err {
-		return err
+
+	// check tags
+	if cnt := this.tagCnt(); cnt > limits.MaxTagCnt && !ec.add(fmt.Errorf("%w: %d > %d", ErrTooManyTags, cnt, limits.MaxTagCnt)) {
+		return ec.err()
 	}
+	this.eachTag(func(k string, v string, src tagSource) bool {
+		ksize := len(k)
+		if ksize == 0 && !ec.add(&TagError{Key: k, Value: v, Reason: ErrEmptyTagk}) {
+			return false
+		}
+		if ksize > limits.MaxTagkLen && !ec.add(&TagError{Key: k, Value: v, Reason: ErrTagkTooLong}) {
+			return false
+		}
+
+		vsize := len(v)
+		if vsize == 0 && !ec.add(&TagError{Key: k, Value: v, Reason: ErrEmptyTagv}) {
+			return false
+		}
+		if vsize > limits.MaxTagvLen && !ec.add(&TagError{Key: k, Value: v, Reason: ErrTagvTooLong}) {
+			return false
+		}
+		return true
+	})
 
-	return nil
+	return ec.err()
+}
+
+func (self *metricBuilder) Push() error {
+	return self.pushClient().push(self)
+}
+
+// builder所属的Client, 未指定时使用默认Client
+func (self *metricBuilder) pushClient() *Client {
+	if self.client != nil {
+		return self.client
+	}
+	return defaultClient()
 }
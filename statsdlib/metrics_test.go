@@ -357,21 +357,35 @@ func TestCheck(t *testing.T) {
 }
 
 func TestPush(t *testing.T) {
-	SetDefaultNs("1")
+	tr := NewMemTransport()
+	c, _ := NewClient(WithTransport(tr), WithNs("1"))
+	old := _defaultClient.Swap(c)
+	defer _defaultClient.Store(old)
 
 	Counter("niean.test")
 	Counter("niean.test", map[string]string{"k": "v"})
-	time.Sleep(time.Second * time.Duration(1))
-
 	CounterN("niean.test", 2)
 	CounterN("niean.test", 2, map[string]string{"k": "v"})
-	time.Sleep(time.Second * time.Duration(1))
-
 	Rpc("caller", "callee", time.Duration(10000000), "ok")
 	Rpc("caller", "callee", time.Duration(10000000), "ok", map[string]string{"k": "v"})
-	time.Sleep(time.Second * time.Duration(1))
-
 	RpcMetric("rpctest", "caller", "callee", time.Duration(10000000), "ok")
 	RpcMetric("rpctest", "caller", "callee", time.Duration(10000000), "ok", map[string]string{"k": "v"})
-	time.Sleep(time.Second * time.Duration(1))
+
+	got := []string{}
+	for _, body := range tr.Payloads() {
+		got = append(got, strings.ReplaceAll(string(body), "\n", " "))
+	}
+	want := []string{
+		"1 1/niean.test c",
+		"1 1/niean.test k=v c",
+		"2 1/niean.test c",
+		"2 1/niean.test k=v c",
+		"10,ok 1/rpc callee=callee caller=caller rpc",
+		"10,ok 1/rpc callee=callee caller=caller k=v rpc",
+		"10,ok 1/rpctest callee=callee caller=caller rpc",
+		"10,ok 1/rpctest callee=callee caller=caller k=v rpc",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("bad payloads:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
 }
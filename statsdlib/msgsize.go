@@ -0,0 +1,13 @@
+//go:build !plan9
+
+package statsdlib
+
+import (
+	"errors"
+	"syscall"
+)
+
+// 包超过socket的大小限制, 如udp payload超过64KB
+func isMsgSize(err error) bool {
+	return errors.Is(err, syscall.EMSGSIZE)
+}
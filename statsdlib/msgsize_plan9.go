@@ -0,0 +1,6 @@
+package statsdlib
+
+// plan9 没有 EMSGSIZE, 不区分
+func isMsgSize(err error) bool {
+	return false
+}
@@ -0,0 +1,195 @@
+package statsdlib
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// 异步发送队列满时的处理方式
+type FullPolicy int
+
+const (
+	DropNewest FullPolicy = iota // 丢弃当前这条
+	DropOldest                   // 丢弃队列里最老的一条, 放入当前这条
+	Block                        // 阻塞等待, 超过timeout后丢弃当前这条
+)
+
+const (
+	DefaultQueueSize    = 4096
+	DefaultBlockTimeout = 100 * time.Millisecond // Block策略下timeout<=0时使用
+)
+
+/***************************************************************************
+ * 异步发送: 上报接口只把编码好的metric放入有界队列, 由后台goroutine发送,
+ * 业务goroutine不会因为socket慢或者拥塞被阻塞(Block策略除外)
+ **************************************************************************/
+type asyncQueue struct {
+	ch      chan *[]byte
+	policy  FullPolicy
+	timeout time.Duration
+	dropped atomic.Uint64
+	closed  atomic.Bool
+	pending atomic.Int64 // 已放入、还没有发送完的条数
+	abort   atomic.Bool  // 关闭超时, 剩余的直接丢弃
+
+	send   func([]byte) error
+	logger logger
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newAsyncQueue(size int, policy FullPolicy, timeout time.Duration, send func([]byte) error, lg logger) *asyncQueue {
+	if size <= 0 {
+		size = DefaultQueueSize
+	}
+	if policy == Block && timeout <= 0 {
+		timeout = DefaultBlockTimeout
+	}
+	q := &asyncQueue{
+		ch:      make(chan *[]byte, size),
+		policy:  policy,
+		timeout: timeout,
+		send:    send,
+		logger:  lg,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go q.loop()
+	return q
+}
+
+// 放入编码好的buffer, 发送后或者被丢弃时归还到buffer池, 被丢弃时返回错误
+func (this *asyncQueue) put(record *[]byte) error {
+	if this.closed.Load() {
+		this.dropped.Add(1)
+		putBuf(record)
+		return ErrClosed
+	}
+
+	this.pending.Add(1)
+	select {
+	case this.ch <- record:
+		return nil
+	default:
+	}
+
+	switch this.policy {
+	case DropOldest:
+		select {
+		case old := <-this.ch:
+			this.pending.Add(-1)
+			this.dropped.Add(1)
+			putBuf(old)
+		default:
+		}
+		select {
+		case this.ch <- record:
+			return nil
+		default:
+		}
+	case Block:
+		timer := time.NewTimer(this.timeout)
+		defer timer.Stop()
+		select {
+		case this.ch <- record:
+			return nil
+		case <-timer.C:
+		case <-this.stop:
+			this.pending.Add(-1)
+			this.dropped.Add(1)
+			putBuf(record)
+			return ErrClosed
+		}
+	}
+
+	this.pending.Add(-1)
+	this.dropped.Add(1)
+	putBuf(record)
+	return fmt.Errorf("metrics queue full")
+}
+
+func (this *asyncQueue) loop() {
+	defer close(this.done)
+
+	for {
+		select {
+		case record := <-this.ch:
+			this.sendOne(record)
+		case <-this.stop:
+			// 发出队列里剩余的
+			for {
+				select {
+				case record := <-this.ch:
+					this.sendOne(record)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (this *asyncQueue) sendOne(record *[]byte) {
+	defer this.pending.Add(-1)
+	if this.abort.Load() {
+		this.dropped.Add(1)
+		putBuf(record)
+		return
+	}
+	err := this.send(*record)
+	putBuf(record)
+	if err != nil {
+		this.logger.Erro("metrics async send error", "err", err)
+	}
+}
+
+// 等待已放入的metric发送完, 最多等到ctx结束
+func (this *asyncQueue) flush(ctx context.Context) error {
+	if this.pending.Load() <= 0 {
+		return nil
+	}
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+	for this.pending.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// 停止接收, 发出队列里剩余的metric
+func (this *asyncQueue) close() {
+	this.closeCtx(context.Background())
+}
+
+// 同 close, ctx结束时丢弃队列里剩余的metric, 计入dropped;
+// 正在发送的一条留在后台发完, 不等待也不计入
+func (this *asyncQueue) closeCtx(ctx context.Context) error {
+	if this.closed.Swap(true) {
+		return nil
+	}
+	close(this.stop)
+	select {
+	case <-this.done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	this.abort.Store(true)
+	for {
+		select {
+		case record := <-this.ch:
+			this.pending.Add(-1)
+			this.dropped.Add(1)
+			putBuf(record)
+		default:
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build race
+
+package statsdlib
+
+// -race 时 sync.Pool 会随机丢弃放回的对象, 内存分配的测试不准确
+func init() {
+	raceEnabled = true
+}
@@ -0,0 +1,336 @@
+package statsdlib
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+/***************************************************************************
+ * Reporter: 上报接口, 业务代码依赖接口而不是包级别函数, 方便替换实现
+ *   type Server struct{ Metrics statsd.Reporter }
+ *   srv := &Server{Metrics: statsd.DefaultReporter()}
+ * 实现:
+ *   *Client                默认的实现
+ *   DefaultReporter()      转给默认Client, Init之后跟随新的Client
+ *   NopReporter()          什么都不做, 用于关闭上报
+ *   MultiReporter(rs...)   同时上报到多个Reporter
+ *   RecordingReporter      记录每次调用, 用于测试, 不校验也不编码
+ * ctx版本的接口和预注册的handle只在Client上提供
+ **************************************************************************/
+
+type Reporter interface {
+	RpcMetric(metric string, caller string, callee string, latency time.Duration, code interface{}, tags ...map[string]string) error
+	RpcMetricE(metric string, caller string, callee string, latency time.Duration, code interface{}, tags ...map[string]string) error
+	Rpc(caller string, callee string, latency time.Duration, code interface{}, tags ...map[string]string) error
+	RpcE(caller string, callee string, latency time.Duration, code interface{}, tags ...map[string]string) error
+	Counter(metric string, tags ...map[string]string) error
+	CounterN(metric string, cnt int, tags ...map[string]string) error
+	CounterE(metric string, tags ...map[string]string) error
+	CounterNE(metric string, cnt int, tags ...map[string]string) error
+	Gauge(metric string, value float64, tags ...map[string]string) error
+	Ratio(metric string, code string) error
+	RatioN(metric string, code string, cnt int) error
+	Percentile(metric string, value float64, percentiles []string, tags ...map[string]string) error
+}
+
+var _ Reporter = (*Client)(nil)
+
+// 转给默认Client的Reporter, 与包级别接口一致
+func DefaultReporter() Reporter {
+	return defaultReporter{}
+}
+
+type defaultReporter struct{}
+
+func (defaultReporter) RpcMetric(metric string, caller string, callee string, latency time.Duration, code interface{}, tags ...map[string]string) error {
+	return defaultClient().RpcMetric(metric, caller, callee, latency, code, tags...)
+}
+
+func (defaultReporter) RpcMetricE(metric string, caller string, callee string, latency time.Duration, code interface{}, tags ...map[string]string) error {
+	return defaultClient().RpcMetricE(metric, caller, callee, latency, code, tags...)
+}
+
+func (defaultReporter) Rpc(caller string, callee string, latency time.Duration, code interface{}, tags ...map[string]string) error {
+	return defaultClient().Rpc(caller, callee, latency, code, tags...)
+}
+
+func (defaultReporter) RpcE(caller string, callee string, latency time.Duration, code interface{}, tags ...map[string]string) error {
+	return defaultClient().RpcE(caller, callee, latency, code, tags...)
+}
+
+func (defaultReporter) Counter(metric string, tags ...map[string]string) error {
+	return defaultClient().Counter(metric, tags...)
+}
+
+func (defaultReporter) CounterN(metric string, cnt int, tags ...map[string]string) error {
+	return defaultClient().CounterN(metric, cnt, tags...)
+}
+
+func (defaultReporter) CounterE(metric string, tags ...map[string]string) error {
+	return defaultClient().CounterE(metric, tags...)
+}
+
+func (defaultReporter) CounterNE(metric string, cnt int, tags ...map[string]string) error {
+	return defaultClient().CounterNE(metric, cnt, tags...)
+}
+
+func (defaultReporter) Gauge(metric string, value float64, tags ...map[string]string) error {
+	return defaultClient().Gauge(metric, value, tags...)
+}
+
+func (defaultReporter) Ratio(metric string, code string) error {
+	return defaultClient().Ratio(metric, code)
+}
+
+func (defaultReporter) RatioN(metric string, code string, cnt int) error {
+	return defaultClient().RatioN(metric, code, cnt)
+}
+
+func (defaultReporter) Percentile(metric string, value float64, percentiles []string, tags ...map[string]string) error {
+	return defaultClient().Percentile(metric, value, percentiles, tags...)
+}
+
+// 什么都不做, 总是返回nil
+func NopReporter() Reporter {
+	return nopReporter{}
+}
+
+type nopReporter struct{}
+
+func (nopReporter) RpcMetric(metric string, caller string, callee string, latency time.Duration, code interface{}, tags ...map[string]string) error {
+	return nil
+}
+
+func (nopReporter) RpcMetricE(metric string, caller string, callee string, latency time.Duration, code interface{}, tags ...map[string]string) error {
+	return nil
+}
+
+func (nopReporter) Rpc(caller string, callee string, latency time.Duration, code interface{}, tags ...map[string]string) error {
+	return nil
+}
+
+func (nopReporter) RpcE(caller string, callee string, latency time.Duration, code interface{}, tags ...map[string]string) error {
+	return nil
+}
+
+func (nopReporter) Counter(metric string, tags ...map[string]string) error {
+	return nil
+}
+
+func (nopReporter) CounterN(metric string, cnt int, tags ...map[string]string) error {
+	return nil
+}
+
+func (nopReporter) CounterE(metric string, tags ...map[string]string) error {
+	return nil
+}
+
+func (nopReporter) CounterNE(metric string, cnt int, tags ...map[string]string) error {
+	return nil
+}
+
+func (nopReporter) Gauge(metric string, value float64, tags ...map[string]string) error {
+	return nil
+}
+
+func (nopReporter) Ratio(metric string, code string) error {
+	return nil
+}
+
+func (nopReporter) RatioN(metric string, code string, cnt int) error {
+	return nil
+}
+
+func (nopReporter) Percentile(metric string, value float64, percentiles []string, tags ...map[string]string) error {
+	return nil
+}
+
+/**
+ * @note
+ * 同时上报到多个Reporter, 按顺序调用, 一个失败不影响其他的
+ * @param Reporter $reporters
+ *
+ * @return Reporter 返回所有错误, 多个错误时用 errors.Join 合并
+ */
+func MultiReporter(reporters ...Reporter) Reporter {
+	return multiReporter(append([]Reporter(nil), reporters...))
+}
+
+type multiReporter []Reporter
+
+func (this multiReporter) each(fn func(r Reporter) error) error {
+	var errs []error
+	for _, r := range this {
+		if err := fn(r); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	return errors.Join(errs...)
+}
+
+func (this multiReporter) RpcMetric(metric string, caller string, callee string, latency time.Duration, code interface{}, tags ...map[string]string) error {
+	return this.each(func(r Reporter) error { return r.RpcMetric(metric, caller, callee, latency, code, tags...) })
+}
+
+func (this multiReporter) RpcMetricE(metric string, caller string, callee string, latency time.Duration, code interface{}, tags ...map[string]string) error {
+	return this.each(func(r Reporter) error { return r.RpcMetricE(metric, caller, callee, latency, code, tags...) })
+}
+
+func (this multiReporter) Rpc(caller string, callee string, latency time.Duration, code interface{}, tags ...map[string]string) error {
+	return this.each(func(r Reporter) error { return r.Rpc(caller, callee, latency, code, tags...) })
+}
+
+func (this multiReporter) RpcE(caller string, callee string, latency time.Duration, code interface{}, tags ...map[string]string) error {
+	return this.each(func(r Reporter) error { return r.RpcE(caller, callee, latency, code, tags...) })
+}
+
+func (this multiReporter) Counter(metric string, tags ...map[string]string) error {
+	return this.each(func(r Reporter) error { return r.Counter(metric, tags...) })
+}
+
+func (this multiReporter) CounterN(metric string, cnt int, tags ...map[string]string) error {
+	return this.each(func(r Reporter) error { return r.CounterN(metric, cnt, tags...) })
+}
+
+func (this multiReporter) CounterE(metric string, tags ...map[string]string) error {
+	return this.each(func(r Reporter) error { return r.CounterE(metric, tags...) })
+}
+
+func (this multiReporter) CounterNE(metric string, cnt int, tags ...map[string]string) error {
+	return this.each(func(r Reporter) error { return r.CounterNE(metric, cnt, tags...) })
+}
+
+func (this multiReporter) Gauge(metric string, value float64, tags ...map[string]string) error {
+	return this.each(func(r Reporter) error { return r.Gauge(metric, value, tags...) })
+}
+
+func (this multiReporter) Ratio(metric string, code string) error {
+	return this.each(func(r Reporter) error { return r.Ratio(metric, code) })
+}
+
+func (this multiReporter) RatioN(metric string, code string, cnt int) error {
+	return this.each(func(r Reporter) error { return r.RatioN(metric, code, cnt) })
+}
+
+func (this multiReporter) Percentile(metric string, value float64, percentiles []string, tags ...map[string]string) error {
+	return this.each(func(r Reporter) error { return r.Percentile(metric, value, percentiles, tags...) })
+}
+
+// RecordingReporter 记录的一次调用, 与接口无关的字段为零值
+type ReportCall struct {
+	Method      string            // 调用的接口, 如 CounterN, RpcMetricE
+	Metric      string            // Rpc/RpcE 为 rpc
+	Tags        map[string]string // tags的拷贝
+	Caller      string            // Rpc*
+	Callee      string            // Rpc*
+	Latency     time.Duration     // Rpc*
+	Code        interface{}       // Rpc* 的code, Ratio* 的code
+	Cnt         int               // Counter*/Ratio* 的计数, Counter/CounterE/Ratio 为1
+	Value       float64           // Gauge/Percentile
+	Percentiles []string          // Percentile
+}
+
+// 记录每次调用, 总是返回nil; 检查编码后的结果见 statsdtest 包
+type RecordingReporter struct {
+	mu    sync.Mutex
+	calls []ReportCall
+}
+
+func NewRecordingReporter() *RecordingReporter {
+	return &RecordingReporter{}
+}
+
+func (this *RecordingReporter) record(call ReportCall, tags []map[string]string) error {
+	if t := firstTags(tags); t != nil {
+		call.Tags = make(map[string]string, len(t))
+		for k, v := range t {
+			call.Tags[k] = v
+		}
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.calls = append(this.calls, call)
+	return nil
+}
+
+// 已记录的调用的拷贝, 按调用的顺序
+func (this *RecordingReporter) Calls() []ReportCall {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return append([]ReportCall(nil), this.calls...)
+}
+
+// 指定metric的调用, method为空时匹配所有接口
+func (this *RecordingReporter) Find(method string, metric string) []ReportCall {
+	calls := []ReportCall{}
+	for _, call := range this.Calls() {
+		if call.Metric == metric && (method == "" || call.Method == method) {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// 清空已记录的调用
+func (this *RecordingReporter) Reset() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.calls = nil
+}
+
+func (this *RecordingReporter) RpcMetric(metric string, caller string, callee string, latency time.Duration, code interface{}, tags ...map[string]string) error {
+	return this.record(ReportCall{Method: "RpcMetric", Metric: metric, Caller: caller, Callee: callee, Latency: latency, Code: code}, tags)
+}
+
+func (this *RecordingReporter) RpcMetricE(metric string, caller string, callee string, latency time.Duration, code interface{}, tags ...map[string]string) error {
+	return this.record(ReportCall{Method: "RpcMetricE", Metric: metric, Caller: caller, Callee: callee, Latency: latency, Code: code}, tags)
+}
+
+func (this *RecordingReporter) Rpc(caller string, callee string, latency time.Duration, code interface{}, tags ...map[string]string) error {
+	return this.record(ReportCall{Method: "Rpc", Metric: "rpc", Caller: caller, Callee: callee, Latency: latency, Code: code}, tags)
+}
+
+func (this *RecordingReporter) RpcE(caller string, callee string, latency time.Duration, code interface{}, tags ...map[string]string) error {
+	return this.record(ReportCall{Method: "RpcE", Metric: "rpc", Caller: caller, Callee: callee, Latency: latency, Code: code}, tags)
+}
+
+func (this *RecordingReporter) Counter(metric string, tags ...map[string]string) error {
+	return this.record(ReportCall{Method: "Counter", Metric: metric, Cnt: 1}, tags)
+}
+
+func (this *RecordingReporter) CounterN(metric string, cnt int, tags ...map[string]string) error {
+	return this.record(ReportCall{Method: "CounterN", Metric: metric, Cnt: cnt}, tags)
+}
+
+func (this *RecordingReporter) CounterE(metric string, tags ...map[string]string) error {
+	return this.record(ReportCall{Method: "CounterE", Metric: metric, Cnt: 1}, tags)
+}
+
+func (this *RecordingReporter) CounterNE(metric string, cnt int, tags ...map[string]string) error {
+	return this.record(ReportCall{Method: "CounterNE", Metric: metric, Cnt: cnt}, tags)
+}
+
+func (this *RecordingReporter) Gauge(metric string, value float64, tags ...map[string]string) error {
+	return this.record(ReportCall{Method: "Gauge", Metric: metric, Value: value}, tags)
+}
+
+func (this *RecordingReporter) Ratio(metric string, code string) error {
+	return this.record(ReportCall{Method: "Ratio", Metric: metric, Code: code, Cnt: 1}, nil)
+}
+
+func (this *RecordingReporter) RatioN(metric string, code string, cnt int) error {
+	return this.record(ReportCall{Method: "RatioN", Metric: metric, Code: code, Cnt: cnt}, nil)
+}
+
+func (this *RecordingReporter) Percentile(metric string, value float64, percentiles []string, tags ...map[string]string) error {
+	call := ReportCall{Method: "Percentile", Metric: metric, Value: value, Percentiles: append([]string(nil), percentiles...)}
+	return this.record(call, tags)
+}
@@ -0,0 +1,121 @@
+package statsdlib
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// 调用Reporter的所有接口
+func reportAll(r Reporter) []error {
+	tags := map[string]string{"k": "v"}
+	return []error{
+		r.RpcMetric("rpc.m", "caller", "callee", time.Millisecond, "ok", tags),
+		r.RpcMetricE("rpc.m", "caller", "callee", time.Millisecond, 200),
+		r.Rpc("caller", "callee", time.Millisecond, "ok"),
+		r.RpcE("caller", "callee", time.Millisecond, "ok"),
+		r.Counter("c", tags),
+		r.CounterN("c", 2),
+		r.CounterE("c"),
+		r.CounterNE("c", 3),
+		r.Gauge("g", 1.5, tags),
+		r.Ratio("r", "ok"),
+		r.RatioN("r", "ok", 2),
+		r.Percentile("p", 1, []string{"50"}),
+	}
+}
+
+func TestNopReporter(t *testing.T) {
+	for i, err := range reportAll(NopReporter()) {
+		if err != nil {
+			t.Errorf("%d: unexpected error %v", i, err)
+		}
+	}
+}
+
+func TestDefaultReporter(t *testing.T) {
+	tr := NewMemTransport()
+	c, _ := NewClient(WithTransport(tr), WithNs("ns"))
+	defer c.Close(context.Background())
+	old := _defaultClient.Swap(c)
+	defer _defaultClient.Store(old)
+
+	for i, err := range reportAll(DefaultReporter()) {
+		if err != nil {
+			t.Errorf("%d: unexpected error %v", i, err)
+		}
+	}
+	if n := len(tr.Payloads()); n != 12 {
+		t.Errorf("expect 12 payloads, got %d", n)
+	}
+}
+
+func TestRecordingReporter(t *testing.T) {
+	r := NewRecordingReporter()
+	reportAll(r)
+
+	calls := r.Calls()
+	if len(calls) != 12 {
+		t.Fatalf("expect 12 calls, got %d", len(calls))
+	}
+	want := ReportCall{Method: "RpcMetric", Metric: "rpc.m", Tags: map[string]string{"k": "v"},
+		Caller: "caller", Callee: "callee", Latency: time.Millisecond, Code: "ok"}
+	if !reflect.DeepEqual(calls[0], want) {
+		t.Errorf("bad call: %+v", calls[0])
+	}
+	if calls := r.Find("Rpc", "rpc"); len(calls) != 1 {
+		t.Errorf("bad rpc calls: %+v", calls)
+	}
+
+	cnt := 0
+	for _, call := range r.Find("", "c") {
+		cnt += call.Cnt
+	}
+	if cnt != 7 {
+		t.Errorf("bad counter sum: %d", cnt)
+	}
+	if calls := r.Find("Percentile", "p"); len(calls) != 1 || !reflect.DeepEqual(calls[0].Percentiles, []string{"50"}) {
+		t.Errorf("bad percentile calls: %+v", calls)
+	}
+
+	// tags是拷贝
+	tags := map[string]string{"k": "v"}
+	r.Reset()
+	r.Counter("c", tags)
+	tags["k"] = "changed"
+	if got := r.Calls()[0].Tags["k"]; got != "v" {
+		t.Errorf("tags not copied: %s", got)
+	}
+}
+
+func TestMultiReporter(t *testing.T) {
+	r1, r2 := NewRecordingReporter(), NewRecordingReporter()
+	m := MultiReporter(r1, NopReporter(), r2)
+	for i, err := range reportAll(m) {
+		if err != nil {
+			t.Errorf("%d: unexpected error %v", i, err)
+		}
+	}
+	if !reflect.DeepEqual(r1.Calls(), r2.Calls()) || len(r1.Calls()) != 12 {
+		t.Errorf("bad fan out: %d, %d", len(r1.Calls()), len(r2.Calls()))
+	}
+
+	// 一个失败不影响其他的
+	tr := NewMemTransport()
+	c, _ := NewClient(WithTransport(tr), WithNs("ns"))
+	defer c.Close(context.Background())
+	r1.Reset()
+	m = MultiReporter(c, r1, c)
+	err := m.Counter("c", map[string]string{"k": ""})
+	if !errors.Is(err, ErrEmptyTagv) || len(r1.Calls()) != 1 {
+		t.Errorf("bad error: %v", err)
+	}
+	if errs, ok := err.(interface{ Unwrap() []error }); !ok || len(errs.Unwrap()) != 2 {
+		t.Errorf("expect 2 joined errors: %v", err)
+	}
+	if err := MultiReporter(c, r1).Counter("c", map[string]string{"k": ""}); !errors.Is(err, ErrEmptyTagv) {
+		t.Errorf("bad error: %v", err)
+	}
+}
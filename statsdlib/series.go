@@ -0,0 +1,20 @@
+package statsdlib
+
+// 一条时间序列的标识, 由 ns + metric + 排序后的tags 唯一确定,
+// 内容即 Build() 中除value和aggregator以外的部分, 形如 ns/metric\nk1=v1\nk2=v2,
+// 相同序列的编码逐字节相同, 可用于去重、缓存编码结果和聚合
+type SeriesKey string
+
+func NewSeriesKey(ns string, metric string, tags map[string]string) SeriesKey {
+	p := point{ns: ns, metric: metric, tags: tags}
+	return SeriesKey(p.appendSeries(nil))
+}
+
+func (this SeriesKey) String() string {
+	return string(this)
+}
+
+// 拼上value和aggregator, 得到完整的一条记录
+func (this SeriesKey) Record(value string, aggregator string) string {
+	return value + "\n" + string(this) + "\n" + aggregator
+}
@@ -0,0 +1,156 @@
+package statsdlib
+
+import (
+	"context"
+)
+
+/***************************************************************************
+ * Flush/Close: 程序退出前发出预聚合、异步队列和批量发送中的metric
+ *   ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+ *   defer cancel()
+ *   lost, err := statsd.Close(ctx)
+ * 最多等到ctx结束, 返回期间丢失的metric条数(发送失败、队列丢弃、超时丢弃),
+ * 超时时已经交给Transport、正在发送的不计入, 之后仍可能发出;
+ * Close之后的上报都返回 ErrClosed, 再次Flush/Close直接返回
+ **************************************************************************/
+
+/**
+ * @note
+ * 发出默认Client中缓存的metric, 不关闭
+ * @param context $ctx 超时或取消时不再等待
+ *
+ * @return int, error 丢失的metric条数; ctx结束时返回ctx.Err()
+ */
+func Flush(ctx context.Context) (int, error) {
+	c := _defaultClient.Load()
+	if c == nil {
+		return 0, nil
+	}
+	return c.Flush(ctx)
+}
+
+/**
+ * @note
+ * 关闭默认Client, 之后包级别的上报都返回 ErrClosed, 再次 Init 后恢复
+ * @param context $ctx 超时或取消时丢弃还没有发出的metric
+ *
+ * @return int, error 丢失的metric条数; ctx结束时返回ctx.Err()
+ */
+func Close(ctx context.Context) (int, error) {
+	c := _defaultClient.Load()
+	if c == nil {
+		return 0, nil
+	}
+	return c.Close(ctx)
+}
+
+// 发出预聚合、异步队列和批量发送中的metric; 超时后还没发出的预聚合结果留到下次flush
+func (this *Client) Flush(ctx context.Context) (int, error) {
+	if this.closed.Load() {
+		return 0, nil
+	}
+	before := this.lost()
+
+	var err error
+	for _, aggr := range []*aggregator{this.counterAggr, this.rpcAggr} {
+		if aggr == nil {
+			continue
+		}
+		if err2 := aggr.flushCtx(ctx); err2 != nil {
+			err = err2
+		}
+	}
+	if this.queue != nil {
+		if err2 := this.queue.flush(ctx); err2 != nil {
+			err = err2
+		}
+	}
+	if this.batch != nil {
+		if err2 := this.batch.flush(); err2 != nil {
+			err = err2
+		}
+	}
+	return int(this.lost() - before), err
+}
+
+// 发出剩余的metric并关闭连接, 超时后丢弃还没发出的; 之后的上报都返回 ErrClosed
+// 每一步都最多等到ctx结束, 卡在Transport上的发送留在后台, 不计入丢失
+func (this *Client) Close(ctx context.Context) (int, error) {
+	if this.closed.Swap(true) {
+		return 0, nil
+	}
+	// 等待已经通过检查的上报完成, 之后不会再有metric放入预聚合/队列
+	err := waitCtx(ctx, func() {
+		this.pushMu.Lock()
+		this.pushMu.Unlock()
+	})
+	before := this.lost()
+
+	if this.selfStats != nil {
+		if err2 := waitCtx(ctx, this.selfStats.close); err2 != nil {
+			err = err2
+		}
+	}
+	for _, aggr := range []*aggregator{this.counterAggr, this.rpcAggr} {
+		if aggr == nil {
+			continue
+		}
+		abandoned, err2 := aggr.closeCtx(ctx)
+		this.stats.abandoned.Add(uint64(abandoned))
+		if err2 != nil {
+			err = err2
+		}
+	}
+	if this.queue != nil {
+		if err2 := this.queue.closeCtx(ctx); err2 != nil {
+			err = err2
+		}
+	}
+	if this.batch != nil {
+		if err2 := this.batch.closeCtx(ctx); err2 != nil {
+			err = err2
+		}
+	}
+	var closeErr error
+	if err2 := waitCtx(ctx, func() { closeErr = this.closeTransport() }); err2 != nil {
+		err = err2
+	} else if closeErr != nil {
+		err = closeErr
+	}
+
+	lost := int(this.lost() - before)
+	if lost > 0 {
+		this.logger.Warn("metrics lost on close", "lost", lost)
+	}
+	this.logger.flush()
+	if this.logFile != nil {
+		this.logFile.Close()
+	}
+	return lost, err
+}
+
+// 在新的goroutine里执行fn, 最多等到ctx结束; 超时后fn继续在后台执行
+func waitCtx(ctx context.Context, fn func()) error {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	// fn与ctx同时结束时以fn为准
+	select {
+	case <-done:
+		return nil
+	default:
+		return ctx.Err()
+	}
+}
+
+// 累计丢失的metric条数
+func (this *Client) lost() uint64 {
+	return this.stats.sendLost.Load() + this.Dropped() + this.stats.abandoned.Load()
+}
@@ -0,0 +1,235 @@
+package statsdlib
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Send阻塞到release被关闭
+type blockingTransport struct {
+	MemTransport
+	release chan struct{}
+	once    sync.Once
+	waiting atomic.Int32 // 阻塞在Send中的个数
+}
+
+func newBlockingTransport() *blockingTransport {
+	return &blockingTransport{release: make(chan struct{})}
+}
+
+func (this *blockingTransport) Send(body []byte) error {
+	this.waiting.Add(1)
+	<-this.release
+	this.waiting.Add(-1)
+	return this.MemTransport.Send(body)
+}
+
+// 等到有n个Send阻塞
+func (this *blockingTransport) waitSending(t *testing.T, n int32) {
+	deadline := time.Now().Add(time.Second)
+	for this.waiting.Load() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expect %d blocked sends, got %d", n, this.waiting.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (this *blockingTransport) unblock() {
+	this.once.Do(func() { close(this.release) })
+}
+
+func TestFlush(t *testing.T) {
+	tr := NewMemTransport()
+	c, _ := NewClient(WithTransport(tr), WithNs("ns"), WithCounterAggregation(time.Hour), WithAsync(16, DropNewest, 0), WithBatch(DefaultBatchMTU, time.Hour))
+	defer c.Close(context.Background())
+
+	c.Counter("hit")
+	c.Counter("hit")
+	c.Gauge("g", 1)
+	lost, err := c.Flush(context.Background())
+	if lost != 0 || err != nil {
+		t.Errorf("flush: lost %d, err %v", lost, err)
+	}
+
+	metrics, err := DecodeBatch(concatPayloads(tr))
+	if err != nil || len(metrics) != 2 {
+		t.Fatalf("bad payloads: %q, %v", tr.Payloads(), err)
+	}
+	if st := c.Stats(); st.Sent != 2 {
+		t.Errorf("bad stats: %+v", st)
+	}
+}
+
+func concatPayloads(tr *MemTransport) []byte {
+	p := tr.Payloads()
+	if len(p) != 1 {
+		return nil
+	}
+	return p[0]
+}
+
+func TestCloseTwice(t *testing.T) {
+	tr := NewMemTransport()
+	c, _ := NewClient(WithTransport(tr), WithNs("ns"), WithCounterAggregation(time.Hour))
+	c.Counter("hit")
+	if lost, err := c.Close(context.Background()); lost != 0 || err != nil {
+		t.Errorf("close: lost %d, err %v", lost, err)
+	}
+	if len(tr.Payloads()) != 1 {
+		t.Errorf("aggregation not flushed on close: %q", tr.Payloads())
+	}
+
+	// 关闭之后
+	if err := c.Counter("hit"); !errors.Is(err, ErrClosed) {
+		t.Errorf("expect ErrClosed, got %v", err)
+	}
+	if err := c.NewCounter("hit").Inc(); !errors.Is(err, ErrClosed) {
+		t.Errorf("handle: expect ErrClosed, got %v", err)
+	}
+	if err := c.SetAddr("127.0.0.1:788"); !errors.Is(err, ErrClosed) {
+		t.Errorf("SetAddr: expect ErrClosed, got %v", err)
+	}
+	if lost, err := c.Flush(context.Background()); lost != 0 || err != nil {
+		t.Errorf("flush after close: lost %d, err %v", lost, err)
+	}
+	if lost, err := c.Close(context.Background()); lost != 0 || err != nil {
+		t.Errorf("close twice: lost %d, err %v", lost, err)
+	}
+}
+
+func TestCloseTimeoutQueue(t *testing.T) {
+	tr := newBlockingTransport()
+	c, _ := NewClient(WithTransport(tr), WithNs("ns"), WithAsync(16, DropNewest, 0))
+	for i := 0; i < 5; i++ {
+		c.Counter("hit")
+	}
+	tr.waitSending(t, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := c.Flush(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("flush: expect deadline exceeded, got %v", err)
+	}
+
+	// 超时后丢弃队列里剩余的, 不等待正在发送的一条
+	defer tr.unblock()
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	lost, err := c.Close(ctx)
+	if lost != 4 || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("close: lost %d, err %v", lost, err)
+	}
+
+	// 正在发送的一条在后台发完
+	tr.unblock()
+	deadline := time.Now().Add(time.Second)
+	for len(tr.Payloads()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := len(tr.Payloads()); n != 1 {
+		t.Errorf("expect 1 sent, got %d", n)
+	}
+}
+
+// Transport一直阻塞时, Close最多等到ctx结束
+func TestCloseDeadline(t *testing.T) {
+	cases := map[string][]Option{
+		"async":       {WithAsync(16, DropNewest, 0)},
+		"block":       {WithAsync(1, Block, time.Hour)},
+		"batch":       {WithBatch(DefaultBatchMTU, time.Millisecond)},
+		"aggregation": {WithCounterAggregation(time.Millisecond), WithBatch(DefaultBatchMTU, time.Hour)},
+		"sync":        nil,
+	}
+	for name, opts := range cases {
+		tr := newBlockingTransport()
+		c, _ := NewClient(append(opts, WithTransport(tr), WithNs("ns"))...)
+		for i := 0; i < 3; i++ {
+			go c.Counter("hit")
+		}
+		time.Sleep(20 * time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		start := time.Now()
+		_, err := c.Close(ctx)
+		cancel()
+		if elapsed := time.Since(start); elapsed > time.Second || !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s: close took %s, err %v", name, elapsed, err)
+		}
+		if err := c.Counter("hit"); !errors.Is(err, ErrClosed) {
+			t.Errorf("%s: expect ErrClosed after close, got %v", name, err)
+		}
+		tr.unblock()
+	}
+}
+
+func TestCloseTimeoutAggregation(t *testing.T) {
+	tr := NewMemTransport()
+	c, _ := NewClient(WithTransport(tr), WithNs("ns"), WithCounterAggregation(time.Hour))
+	c.Counter("a")
+	c.Counter("b")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	lost, err := c.Close(ctx)
+	if lost != 2 || !errors.Is(err, context.Canceled) {
+		t.Errorf("close: lost %d, err %v", lost, err)
+	}
+	if st := c.Stats(); st.Abandoned != 2 {
+		t.Errorf("bad stats: %+v", st)
+	}
+}
+
+func TestPackageClose(t *testing.T) {
+	tr := NewMemTransport()
+	c, _ := NewClient(WithTransport(tr), WithNs("ns"), WithCounterAggregation(time.Hour))
+	old := _defaultClient.Swap(c)
+	defer _defaultClient.Store(old)
+
+	Counter("hit")
+	if lost, err := Flush(context.Background()); lost != 0 || err != nil || len(tr.Payloads()) != 1 {
+		t.Errorf("flush: lost %d, err %v, payloads %q", lost, err, tr.Payloads())
+	}
+	Close(context.Background())
+	if err := Counter("hit"); !errors.Is(err, ErrClosed) {
+		t.Errorf("expect ErrClosed, got %v", err)
+	}
+}
+
+// Close 与上报并发时, 上报成功的metric要么发出, 要么计入lost
+func TestCloseConcurrentPush(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		tr := NewMemTransport()
+		c, _ := NewClient(WithTransport(tr), WithNs("ns"), WithCounterAggregation(time.Hour), WithAsync(1024, Block, time.Second))
+
+		var ok atomic.Int64
+		var wg sync.WaitGroup
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for c.Counter("hit") == nil {
+					ok.Add(1)
+				}
+			}()
+		}
+		time.Sleep(time.Millisecond)
+		lost, err := c.Close(context.Background())
+		wg.Wait()
+
+		var sent int64
+		for _, body := range tr.Payloads() {
+			metrics, _ := DecodeBatch(body)
+			for _, m := range metrics {
+				sent += m.Count
+			}
+		}
+		if sent != ok.Load() || lost != 0 || err != nil {
+			t.Fatalf("round %d: pushed %d, sent %d, lost %d, err %v", i, ok.Load(), sent, lost, err)
+		}
+	}
+}
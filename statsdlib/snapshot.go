@@ -0,0 +1,128 @@
+package statsdlib
+
+/***************************************************************************
+ * Client的可变配置: ns、agent地址(及对应的Transport)、默认tags、限制
+ * 保存在只读的快照里, 修改时拷贝一份再整体原子替换, 可以在运行时并发修改:
+ *   statsd.SetDefaultNs("bj.user_service")
+ *   c.SetAddr("unix:///run/metrics-agent.sock")
+ * 每次上报只读取一次快照, 同一条metric的ns、tags和限制总是来自同一份配置
+ **************************************************************************/
+
+// 只读, 修改时整体替换
+type clientConfig struct {
+	ns        string
+	addr      string
+	transport Transport
+	limits    Limits
+	defTags   map[string]string
+}
+
+// 未初始化的Client使用的配置
+var emptyConfig = &clientConfig{limits: DefaultLimits}
+
+// 当前配置, 不分配内存
+func (this *Client) config() *clientConfig {
+	cfg := this.cfg.Load()
+	if cfg == nil {
+		return emptyConfig
+	}
+	return cfg
+}
+
+// 拷贝当前配置, 由fn修改后替换; 修改之间互斥, 不影响并发的上报
+func (this *Client) updateConfig(fn func(cfg *clientConfig) error) error {
+	this.cfgMu.Lock()
+	defer this.cfgMu.Unlock()
+
+	cfg := *this.config()
+	if err := fn(&cfg); err != nil {
+		return err
+	}
+	this.cfg.Store(&cfg)
+	return nil
+}
+
+func (this *Client) Ns() string {
+	return this.config().ns
+}
+
+func (this *Client) SetNs(ns string) {
+	this.updateConfig(func(cfg *clientConfig) error {
+		cfg.ns = ns
+		return nil
+	})
+}
+
+// agent地址, 使用 WithTransport 时为空
+func (this *Client) Addr() string {
+	return this.config().addr
+}
+
+/**
+ * @note
+ * 切换agent地址: 建立新的Transport, 替换后关闭原来的;
+ * 切换瞬间正在通过原Transport发送的metric可能失败
+ * @param string $addr 格式同 WithAddr
+ *
+ * @return error 地址不合法或Client已关闭时返回错误, 原来的地址不变
+ */
+func (this *Client) SetAddr(addr string) error {
+	var old Transport
+	err := this.updateConfig(func(cfg *clientConfig) error {
+		if this.closed.Load() {
+			return ErrClosed
+		}
+		transport, err := NewTransport(addr)
+		if err != nil {
+			return err
+		}
+		old, cfg.addr, cfg.transport = cfg.transport, addr, transport
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	this.logger.Info("metric transport switched", "addr", addr)
+	if old != nil {
+		if err := old.Close(); err != nil {
+			this.logger.Warn("close old transport error", "err", err)
+		}
+	}
+	return nil
+}
+
+func (this *Client) Limits() Limits {
+	return this.config().limits
+}
+
+/**
+ * @note
+ * 替换长度/个数限制, 未设置(<=0)的项使用 DefaultLimits
+ * @param Limits $limits
+ *
+ * @return error 当前的默认tags不满足新的限制时返回错误, 原来的限制不变
+ */
+func (this *Client) SetLimits(limits Limits) error {
+	limits = limits.withDefaults()
+	return this.updateConfig(func(cfg *clientConfig) error {
+		if _, err := checkDefaultTags(cfg.defTags, limits, this.chars); err != nil {
+			return err
+		}
+		cfg.limits = limits
+		return nil
+	})
+}
+
+// 关闭当前的Transport, 需要先设置closed, 之后 SetAddr 返回错误
+// 等正在发送的包发完再关闭, Close超时后在后台等待
+func (this *Client) closeTransport() error {
+	this.cfgMu.Lock()
+	defer this.cfgMu.Unlock()
+	this.sendMu.Lock()
+	defer this.sendMu.Unlock()
+
+	if cfg := this.cfg.Load(); cfg != nil && cfg.transport != nil {
+		return cfg.transport.Close()
+	}
+	return nil
+}
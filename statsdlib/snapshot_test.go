@@ -0,0 +1,172 @@
+package statsdlib
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSetNs(t *testing.T) {
+	tr := NewMemTransport()
+	c, _ := NewClient(WithTransport(tr), WithNs("ns1"))
+	defer c.Close(context.Background())
+
+	hit := c.NewCounter("hit")
+	hit.Inc()
+	c.Counter("m")
+	c.SetNs("ns2")
+	hit.Inc()
+	c.Counter("m")
+
+	want := []string{"1\nns1/hit\nc", "1\nns1/m\nc", "1\nns2/hit\nc", "1\nns2/m\nc"}
+	p := tr.Payloads()
+	if len(p) != len(want) {
+		t.Fatalf("bad payloads: %q", p)
+	}
+	for i, w := range want {
+		if string(p[i]) != w {
+			t.Errorf("payload %d: got %q, want %q", i, p[i], w)
+		}
+	}
+	if c.Ns() != "ns2" {
+		t.Errorf("bad ns: %s", c.Ns())
+	}
+}
+
+func TestSetLimits(t *testing.T) {
+	c, _ := NewClient(WithTransport(NewMemTransport()), WithNs("ns"), WithDefaultTags(map[string]string{"host": "h", "region": "cn"}))
+	defer c.Close(context.Background())
+
+	hit := c.NewCounter("hit", map[string]string{"a": "1", "b": "2", "c": "3"})
+	if err := c.SetLimits(Limits{MaxTagCnt: 3}); !errors.Is(err, ErrTooManyTags) {
+		t.Errorf("default tags and caller/callee should not fit, got %v", err)
+	}
+	if c.Limits().MaxTagCnt != maxTagCnt {
+		t.Errorf("limits changed by invalid SetLimits: %+v", c.Limits())
+	}
+
+	if err := c.SetLimits(Limits{MaxTagCnt: 4}); err != nil {
+		t.Fatalf("set limits error: %s", err.Error())
+	}
+	if err := hit.Inc(); !errors.Is(err, ErrTooManyTags) {
+		t.Errorf("handle should be checked against new limits, got %v", err)
+	}
+	if err := c.Counter("m"); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestSetAddr(t *testing.T) {
+	var conns [2]net.PacketConn
+	for i := range conns {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Skipf("listen udp error: %s", err.Error())
+		}
+		defer conn.Close()
+		conns[i] = conn
+	}
+	recv := func(conn net.PacketConn) string {
+		buf := make([]byte, 1024)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err.Error()
+		}
+		return string(buf[:n])
+	}
+
+	c, err := NewClient(WithAddr(conns[0].LocalAddr().String()), WithNs("ns"))
+	if err != nil {
+		t.Fatalf("new client error: %s", err.Error())
+	}
+	c.Counter("m1")
+	if got := recv(conns[0]); got != "1\nns/m1\nc" {
+		t.Errorf("bad first agent: %q", got)
+	}
+
+	if err := c.SetAddr("bad://addr"); err == nil {
+		t.Errorf("expect error for bad addr")
+	}
+	if err := c.SetAddr(conns[1].LocalAddr().String()); err != nil {
+		t.Fatalf("set addr error: %s", err.Error())
+	}
+	c.Counter("m2")
+	if got := recv(conns[1]); got != "1\nns/m2\nc" {
+		t.Errorf("bad second agent: %q", got)
+	}
+	if c.Addr() != conns[1].LocalAddr().String() {
+		t.Errorf("bad addr: %s", c.Addr())
+	}
+
+	c.Close(context.Background())
+	if err := c.SetAddr(conns[0].LocalAddr().String()); err == nil {
+		t.Errorf("expect error after close")
+	}
+}
+
+// 并发上报的同时修改配置, 需要 go test -race
+func TestReconfigureConcurrent(t *testing.T) {
+	tr := NewMemTransport()
+	c, _ := NewClient(WithTransport(tr), WithNs("ns0"))
+	defer c.Close(context.Background())
+
+	hit := c.NewCounter("hit", map[string]string{"k": "v"})
+	rpc := c.NewRpcVec("rpc", "api").With("a", "b", "login")
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				c.Counter("m", map[string]string{"k": "v"})
+				c.RpcMetric("rpc", "a", "b", time.Millisecond, "ok")
+				hit.Inc()
+				rpc.Observe(time.Millisecond, 200)
+				c.counterNBuilder("m", 1).Check()
+			}
+		}()
+	}
+	for j := 0; j < 200; j++ {
+		v := strconv.Itoa(j % 2)
+		c.SetNs("ns" + v)
+		c.SetDefaultTags(map[string]string{"version": v})
+		c.SetLimits(Limits{MaxTagCnt: 4 + j%2})
+	}
+	close(stop)
+	wg.Wait()
+
+	for _, body := range tr.Payloads() {
+		m, err := Decode(body)
+		if err != nil {
+			t.Fatalf("bad payload %q: %s", body, err.Error())
+		}
+		if m.Namespace != "ns0" && m.Namespace != "ns1" {
+			t.Errorf("bad ns in %q", body)
+		}
+	}
+}
+
+func TestReconfigureAllocs(t *testing.T) {
+	skipAllocsUnderRace(t)
+	c := newBenchClient(t)
+	defer c.Close(context.Background())
+
+	hit := c.NewCounter("api.hit")
+	c.SetNs("other.ns")
+	hit.Inc() // 重新绑定
+	if allocs := testing.AllocsPerRun(100, func() { hit.Inc() }); allocs != 0 {
+		t.Errorf("CounterHandle: %.1f allocs/op", allocs)
+	}
+}
@@ -0,0 +1,247 @@
+package statsdlib
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+/***************************************************************************
+ * 自身统计: Client发送了多少、失败了多少, 不依赖调用方检查上报接口的返回值
+ *   st := statsd.Stats()
+ *   st.Sent, st.SendErrors, st.Invalid["too_many_tags"] ...
+ * 开启 WithSelfStats 后, 每interval把增量作为counter上报到当前ns下的
+ * statsdlib.* metric, 业务metric不要使用 statsdlib. 前缀;
+ * 自身统计的metric直接交给Transport发送, 不计入统计
+ **************************************************************************/
+
+// 自身统计的metric前缀, 保留给库使用
+const SelfStatsPrefix = "statsdlib."
+
+// Client的累计统计
+type ClientStats struct {
+	Built      uint64            // 通过校验、进入发送流程的metric条数
+	Sent       uint64            // 发送成功的记录条数, 预聚合时多条metric合并为一条记录
+	SentBytes  uint64            // 发送成功的字节数, 包括批量发送的framing
+	Invalid    map[string]uint64 // 校验失败的次数, key为原因, 如 too_many_tags, 见 invalidReasons
+	SendErrors uint64            // 发送(socket)失败的次数
+	SendLost   uint64            // 发送失败丢失的记录条数
+	QueueDrops uint64            // 异步队列满或者关闭后丢弃的metric条数
+	Oversized  uint64            // 超过批量发送的mtu、或者超过udp包大小限制(同时计入SendErrors)的记录条数
+	Abandoned  uint64            // Close超时时丢弃的预聚合结果条数
+	Panics     uint64            // 上报和发送(包括 Transport.Send)时recover的panic次数
+	Limit      LimitStats        // 超出限制时各处理方式触发的次数
+}
+
+// 校验失败的原因, 顺序即 statsCounters.invalid 的下标
+var invalidReasons = [...]struct {
+	err  error
+	name string
+}{
+	{ErrEmptyNs, "empty_ns"},
+	{ErrEmptyMetric, "empty_metric"},
+	{ErrMetricTooLong, "metric_too_long"},
+	{ErrTooManyTags, "too_many_tags"},
+	{ErrEmptyTagk, "empty_tagk"},
+	{ErrTagkTooLong, "tagk_too_long"},
+	{ErrEmptyTagv, "empty_tagv"},
+	{ErrTagvTooLong, "tagv_too_long"},
+	{ErrIllegalChar, "illegal_char"},
+	{ErrNoPercentile, "no_percentile"},
+	{ErrDuplicateLabel, "duplicate_label"},
+	{ErrLabelCount, "label_count"},
+	{nil, "other"},
+}
+
+type statsCounters struct {
+	built      atomic.Uint64
+	sent       atomic.Uint64
+	sentBytes  atomic.Uint64
+	invalid    [len(invalidReasons)]atomic.Uint64
+	sendErrors atomic.Uint64
+	sendLost   atomic.Uint64
+	oversized  atomic.Uint64
+	abandoned  atomic.Uint64
+	panics     atomic.Uint64
+}
+
+// 按原因计数, 多个错误时取第一个能识别的原因
+func (this *statsCounters) addInvalid(err error) {
+	for i, reason := range invalidReasons {
+		if reason.err == nil || errors.Is(err, reason.err) {
+			this.invalid[i].Add(1)
+			return
+		}
+	}
+}
+
+// 默认Client的统计
+func Stats() ClientStats {
+	return defaultClient().Stats()
+}
+
+func (this *Client) Stats() ClientStats {
+	st := ClientStats{
+		Built:      this.stats.built.Load(),
+		Sent:       this.stats.sent.Load(),
+		SentBytes:  this.stats.sentBytes.Load(),
+		Invalid:    map[string]uint64{},
+		SendErrors: this.stats.sendErrors.Load(),
+		SendLost:   this.stats.sendLost.Load(),
+		QueueDrops: this.Dropped(),
+		Oversized:  this.stats.oversized.Load(),
+		Abandoned:  this.stats.abandoned.Load(),
+		Panics:     this.stats.panics.Load(),
+		Limit:      this.LimitStats(),
+	}
+	if this.batch != nil {
+		st.Oversized += this.batch.oversized.Load()
+	}
+	for i, reason := range invalidReasons {
+		if n := this.stats.invalid[i].Load(); n > 0 {
+			st.Invalid[reason.name] = n
+		}
+	}
+	return st
+}
+
+// udp包超过大小限制, 批量发送时已经在batcher中计数
+func (this *Client) countOversized(err error) {
+	if this.batch == nil && isMsgSize(err) {
+		this.stats.oversized.Add(1)
+	}
+}
+
+// body中的记录条数, 见 batch.go 的打包格式
+func recordCount(body []byte) int {
+	if len(body) < len(batchHeader) || string(body[:len(batchHeader)]) != batchHeader {
+		return 1
+	}
+	cnt := 0
+	for rest := body[len(batchHeader):]; len(rest) > 0; cnt++ {
+		size, i := 0, 0
+		for ; i < len(rest) && rest[i] != '\n'; i++ {
+			size = size*10 + int(rest[i]-'0')
+		}
+		if i+1+size > len(rest) {
+			return cnt + 1
+		}
+		rest = rest[i+1+size:]
+	}
+	return cnt
+}
+
+// 开启自身统计的上报, 每interval上报一次增量, interval<=0 时使用 DefaultSelfStatsInterval
+func WithSelfStats(interval time.Duration) Option {
+	return func(c *Client) {
+		if interval <= 0 {
+			interval = DefaultSelfStatsInterval
+		}
+		c.selfStatsInterval = interval
+	}
+}
+
+const DefaultSelfStatsInterval = 10 * time.Second
+
+type selfStats struct {
+	client *Client
+	last   ClientStats
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func newSelfStats(c *Client, interval time.Duration) *selfStats {
+	s := &selfStats{
+		client: c,
+		last:   ClientStats{Invalid: map[string]uint64{}},
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go s.loop(interval)
+	return s
+}
+
+func (this *selfStats) loop(interval time.Duration) {
+	defer close(this.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			this.report()
+		case <-this.stop:
+			return
+		}
+	}
+}
+
+// 上报和上次相比的增量, 没有变化的不上报
+func (this *selfStats) report() {
+	cur := this.client.Stats()
+	last := this.last
+	this.last = cur
+
+	counters := []struct {
+		metric   string
+		cur, old uint64
+	}{
+		{"built", cur.Built, last.Built},
+		{"sent", cur.Sent, last.Sent},
+		{"sent_bytes", cur.SentBytes, last.SentBytes},
+		{"send_errors", cur.SendErrors, last.SendErrors},
+		{"send_lost", cur.SendLost, last.SendLost},
+		{"queue_drops", cur.QueueDrops, last.QueueDrops},
+		{"oversized", cur.Oversized, last.Oversized},
+		{"abandoned", cur.Abandoned, last.Abandoned},
+		{"panics", cur.Panics, last.Panics},
+		{"limit_rejected", cur.Limit.Rejected, last.Limit.Rejected},
+		{"limit_truncated", cur.Limit.Truncated, last.Limit.Truncated},
+		{"limit_dropped", cur.Limit.Dropped, last.Limit.Dropped},
+	}
+	for _, ct := range counters {
+		if ct.cur > ct.old {
+			this.client.pushSelf(ct.metric, int(ct.cur-ct.old), nil)
+		}
+	}
+	for reason, n := range cur.Invalid {
+		if old := last.Invalid[reason]; n > old {
+			this.client.pushSelf("invalid", int(n-old), map[string]string{"reason": reason})
+		}
+	}
+}
+
+// 自身统计直接交给Transport发送, 不经过预聚合/队列/批量发送, 也不计入统计,
+// 否则每次上报都会改变 built/sent, 永远有增量
+func (this *Client) pushSelf(metric string, cnt int, tags map[string]string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("metrics send panic: %v", r)
+		}
+	}()
+
+	cfg := this.config()
+	if cfg.transport == nil {
+		return fmt.Errorf("client not init")
+	}
+	p := this.counterPoint(cfg, SelfStatsPrefix+metric, cnt, "c", nil)
+	p.tags = tags
+	p.defTags = cfg.defTags
+	if err = p.sanitize(this.chars); err != nil {
+		return err
+	}
+	if _, err = p.checkLimits(cfg.limits, this.limitPol); err != nil {
+		return err
+	}
+
+	buf := getBuf()
+	defer putBuf(buf)
+	*buf = p.appendRecord(*buf)
+	return cfg.transport.Send(*buf)
+}
+
+func (this *selfStats) close() {
+	close(this.stop)
+	<-this.done
+}
@@ -0,0 +1,136 @@
+package statsdlib
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	tr := NewMemTransport()
+	c, _ := NewClient(WithTransport(tr), WithNs("ns"), WithLimits(Limits{MaxTagCnt: 1}))
+
+	c.Counter("m")
+	c.Gauge("g", 1)
+	c.Counter("m", map[string]string{"a": "1", "b": "2"})
+	c.Counter("m", map[string]string{"a": ""})
+	c.Percentile("p", 1, nil)
+	c.NewCounterVec("v", "k").With("1", "2").Inc()
+	panicPush(c)
+
+	st := c.Stats()
+	if st.Built != 2 || st.Sent != 2 || st.Panics != 1 {
+		t.Errorf("bad stats: %+v", st)
+	}
+	if want := uint64(len("1\nns/m\nc") + len("1.000000\nns/g\ng")); st.SentBytes != want {
+		t.Errorf("bad sent bytes: %d, want %d", st.SentBytes, want)
+	}
+	want := map[string]uint64{"too_many_tags": 1, "empty_tagv": 1, "no_percentile": 1, "label_count": 1}
+	if len(st.Invalid) != len(want) {
+		t.Errorf("bad invalid: %v", st.Invalid)
+	}
+	for reason, n := range want {
+		if st.Invalid[reason] != n {
+			t.Errorf("bad invalid: %v", st.Invalid)
+		}
+	}
+	if st.Limit.Rejected != 1 {
+		t.Errorf("bad limit stats: %+v", st.Limit)
+	}
+
+	// 发送失败
+	tr.Close()
+	c.Counter("m")
+	if st := c.Stats(); st.SendErrors != 1 || st.SendLost != 1 || st.Sent != 2 {
+		t.Errorf("bad send error stats: %+v", st)
+	}
+	c.Close(context.Background())
+}
+
+func TestStatsBatch(t *testing.T) {
+	tr := NewMemTransport()
+	c, _ := NewClient(WithTransport(tr), WithNs("ns"), WithBatch(DefaultBatchMTU, time.Hour))
+	for i := 0; i < 3; i++ {
+		c.Counter("m")
+	}
+	c.Close(context.Background())
+
+	st := c.Stats()
+	if len(tr.Payloads()) != 1 || st.Built != 3 || st.Sent != 3 || st.SentBytes != uint64(len(tr.Payloads()[0])) {
+		t.Errorf("bad stats: %+v", st)
+	}
+}
+
+func TestRecordCount(t *testing.T) {
+	cases := map[string]int{
+		"1\nns/m\nc":                            1,
+		"\x1ebatch\n8\n1\nns/m\nc":              1,
+		"\x1ebatch\n8\n1\nns/m\nc8\n1\nns/n\nc": 2,
+		"\x1ebatch\n99\n1\nns/m\nc":             1,
+	}
+	for body, want := range cases {
+		if n := recordCount([]byte(body)); n != want {
+			t.Errorf("recordCount(%q) = %d, want %d", body, n, want)
+		}
+	}
+}
+
+func TestSelfStats(t *testing.T) {
+	tr := NewMemTransport()
+	c, _ := NewClient(WithTransport(tr), WithNs("ns"), WithSelfStats(time.Hour))
+	defer c.Close(context.Background())
+
+	c.Counter("m")
+	c.Counter("m", map[string]string{"k": ""})
+	tr.Reset()
+	c.selfStats.report()
+
+	got := map[string]bool{}
+	for _, body := range tr.Payloads() {
+		got[strings.ReplaceAll(string(body), "\n", " ")] = true
+	}
+	for _, want := range []string{
+		"1 ns/statsdlib.built c",
+		"1 ns/statsdlib.sent c",
+		"8 ns/statsdlib.sent_bytes c",
+		"1 ns/statsdlib.invalid reason=empty_tagv c",
+	} {
+		if !got[want] {
+			t.Errorf("missing %q in %v", want, got)
+		}
+	}
+
+	// 自身统计不计入统计, 没有变化时不上报
+	if st := c.Stats(); st.Built != 1 || st.Sent != 1 {
+		t.Errorf("self stats should not be counted: %+v", st)
+	}
+	tr.Reset()
+	c.selfStats.report()
+	if payloads := tr.Payloads(); len(payloads) != 0 {
+		t.Errorf("unexpected %q", payloads)
+	}
+}
+
+func TestStatsOversized(t *testing.T) {
+	// 批量发送时超过mtu
+	tr := NewMemTransport()
+	c, _ := NewClient(WithTransport(tr), WithNs("ns"), WithBatch(24, time.Hour))
+	c.Counter("m")
+	c.Counter(strings.Repeat("m", 32))
+	c.Close(context.Background())
+	if st := c.Stats(); st.Oversized != 1 || st.Sent != 2 {
+		t.Errorf("bad stats: %+v", st)
+	}
+
+	// 超过udp包大小限制
+	agent := listenAgent(t)
+	c, _ = NewClient(WithAddr(agent.LocalAddr().String()), WithNs("ns"), WithLogger(NopLogger()))
+	defer c.Close(context.Background())
+	if err := c.write(make([]byte, 70000)); err == nil {
+		t.Skip("udp payload over 64KB accepted")
+	}
+	if st := c.Stats(); st.Oversized != 1 || st.SendErrors != 1 {
+		t.Errorf("bad stats: %+v", st)
+	}
+}
@@ -0,0 +1,345 @@
+package statsdtest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	statsd "github.com/n9e/metrics-go/statsdlib"
+)
+
+/***************************************************************************
+ * 单元测试中检查上报的metric, 不依赖真实的agent和sleep
+ *   c, rec := statsdtest.New(t, statsd.WithNs("ns"))
+ *   c.Counter("metric", map[string]string{"k": "v"})
+ *   rec.AssertCounter(t, "ns/metric", map[string]string{"k": "v"}, 1)
+ * Recorder 实现 statsd.Transport, 解码收到的每个包并记录;
+ * Agent 在本地udp端口上收包, 用于测试 statsd.Init 等只能配置地址的场景
+ * 开启预聚合/异步/批量发送时, 断言前调用 Client.Flush, 或者 WaitFor
+ **************************************************************************/
+
+// WaitFor 的默认超时
+const DefaultWaitTimeout = 5 * time.Second
+
+// 记录解码后的metric
+type Recorder struct {
+	Timeout time.Duration // WaitFor 的超时, 为0时使用 DefaultWaitTimeout
+
+	mu      sync.Mutex
+	metrics []statsd.Metric
+	errs    []error
+	changed chan struct{} // 每次收到metric时关闭并替换
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{changed: make(chan struct{})}
+}
+
+/**
+ * @note
+ * 创建发送到内存的Client, 测试结束时自动关闭
+ * @param testing.TB $t
+ * @param Option     $opts 其他选项, 不要再设置 WithAddr/WithTransport
+ *
+ * @return *statsd.Client, *Recorder
+ */
+func New(t testing.TB, opts ...statsd.Option) (*statsd.Client, *Recorder) {
+	t.Helper()
+
+	rec := NewRecorder()
+	c, err := statsd.NewClient(append(opts, statsd.WithTransport(rec))...)
+	if err != nil {
+		t.Fatalf("statsdtest: new client: %s", err.Error())
+	}
+	t.Cleanup(func() { c.Close(context.Background()) })
+	return c, rec
+}
+
+// 解码并记录一个包, 解析失败的记录到 Errors
+func (this *Recorder) Send(body []byte) error {
+	metrics, err := statsd.DecodeBatch(body)
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.metrics = append(this.metrics, metrics...)
+	if err != nil {
+		this.errs = append(this.errs, fmt.Errorf("%s: %q", err.Error(), body))
+	}
+	if len(metrics) > 0 {
+		close(this.changed)
+		this.changed = make(chan struct{})
+	}
+	return nil
+}
+
+func (this *Recorder) Close() error {
+	return nil
+}
+
+// 已收到的metric的拷贝, 按收到的顺序
+func (this *Recorder) Metrics() []statsd.Metric {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return append([]statsd.Metric(nil), this.metrics...)
+}
+
+// 已收到的metric条数, 预聚合时多条合并为一条
+func (this *Recorder) Len() int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return len(this.metrics)
+}
+
+// 解析失败的包
+func (this *Recorder) Errors() []error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return append([]error(nil), this.errs...)
+}
+
+// 清空已收到的内容
+func (this *Recorder) Reset() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.metrics = nil
+	this.errs = nil
+}
+
+/**
+ * @note
+ * 等待收到至少n条metric
+ * @param int $n
+ *
+ * @return error 超时时返回错误, 带上已收到的条数
+ */
+func (this *Recorder) WaitFor(n int) error {
+	timeout := this.Timeout
+	if timeout <= 0 {
+		timeout = DefaultWaitTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		this.mu.Lock()
+		got, changed := len(this.metrics), this.changed
+		this.mu.Unlock()
+
+		if got >= n {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return fmt.Errorf("statsdtest: timeout after %s waiting for %d metrics, got %d", timeout, n, got)
+		}
+	}
+}
+
+/**
+ * @note
+ * 查找metric
+ * @param string $name ns/metric, 不带ns时匹配所有ns
+ * @param map    $tags 需要包含的tags, 为空时匹配所有tags
+ *
+ * @return []statsd.Metric
+ */
+func (this *Recorder) Find(name string, tags map[string]string) []statsd.Metric {
+	ns, metric, found := strings.Cut(name, "/")
+	if !found {
+		ns, metric = "", name
+	}
+
+	result := []statsd.Metric{}
+	for _, m := range this.Metrics() {
+		if m.Metric != metric || (ns != "" && m.Namespace != ns) || !hasTags(m.Tags, tags) {
+			continue
+		}
+		result = append(result, m)
+	}
+	return result
+}
+
+func hasTags(got, want map[string]string) bool {
+	for k, v := range want {
+		if gv, ok := got[k]; !ok || gv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// counter(c/ce)的累计值, 预聚合前后结果一致
+func (this *Recorder) Counter(name string, tags map[string]string) int64 {
+	var sum int64
+	for _, m := range this.Find(name, tags) {
+		if m.Aggregator == "c" || m.Aggregator == "ce" {
+			sum += m.Count
+		}
+	}
+	return sum
+}
+
+// gauge最后一次的值
+func (this *Recorder) Gauge(name string, tags map[string]string) (float64, bool) {
+	value, found := 0.0, false
+	for _, m := range this.Find(name, tags) {
+		if m.Aggregator == "g" {
+			value, found = m.Float, true
+		}
+	}
+	return value, found
+}
+
+// rpc(rpc/rpce及其预聚合结果)的累计调用次数和失败次数
+func (this *Recorder) Rpc(name string, tags map[string]string) (calls int64, errors int64) {
+	for _, m := range this.Find(name, tags) {
+		if strings.HasPrefix(m.Aggregator, "rpc") {
+			calls += m.Count
+			errors += m.Errors
+		}
+	}
+	return calls, errors
+}
+
+/**
+ * @note
+ * 断言counter的累计值, tags的匹配规则见 Find
+ * @param testing.TB $t
+ * @param string     $name ns/metric
+ * @param map        $tags
+ * @param int64      $want
+ */
+func (this *Recorder) AssertCounter(t testing.TB, name string, tags map[string]string, want int64) {
+	t.Helper()
+	if got := this.Counter(name, tags); got != want {
+		t.Errorf("counter %s%s = %d, want %d\n%s", name, formatTags(tags), got, want, this)
+	}
+}
+
+// 断言gauge最后一次的值
+func (this *Recorder) AssertGauge(t testing.TB, name string, tags map[string]string, want float64) {
+	t.Helper()
+	got, found := this.Gauge(name, tags)
+	if !found {
+		t.Errorf("gauge %s%s not found\n%s", name, formatTags(tags), this)
+	} else if got != want {
+		t.Errorf("gauge %s%s = %v, want %v\n%s", name, formatTags(tags), got, want, this)
+	}
+}
+
+// 断言rpc的累计调用次数和失败次数
+func (this *Recorder) AssertRpc(t testing.TB, name string, tags map[string]string, calls int64, errors int64) {
+	t.Helper()
+	if gotCalls, gotErrors := this.Rpc(name, tags); gotCalls != calls || gotErrors != errors {
+		t.Errorf("rpc %s%s = %d calls, %d errors, want %d calls, %d errors\n%s", name, formatTags(tags), gotCalls, gotErrors, calls, errors, this)
+	}
+}
+
+// 断言没有收到任何metric
+func (this *Recorder) AssertEmpty(t testing.TB) {
+	t.Helper()
+	if this.Len() != 0 {
+		t.Errorf("expect no metrics\n%s", this)
+	}
+}
+
+// 已收到的metric, 用于断言失败时输出
+func (this *Recorder) String() string {
+	metrics := this.Metrics()
+	if len(metrics) == 0 {
+		return "received: none"
+	}
+
+	b := strings.Builder{}
+	b.WriteString("received:")
+	for _, m := range metrics {
+		fmt.Fprintf(&b, "\n  %s/%s%s %s %s", m.Namespace, m.Metric, formatTags(m.Tags), m.Aggregator, m.Value)
+	}
+	return b.String()
+}
+
+// {k=v,...}, 按key排序
+func formatTags(tags map[string]string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		keys[i] = k + "=" + tags[k]
+	}
+	return "{" + strings.Join(keys, ",") + "}"
+}
+
+// 本地udp端口上的agent, 收到的metric记录到 Recorder
+type Agent struct {
+	*Recorder
+
+	conn *net.UDPConn
+	done chan struct{}
+}
+
+/**
+ * @note
+ * 在 127.0.0.1 的随机udp端口上启动agent, 测试结束时自动关闭
+ *   agent := statsdtest.NewAgent(t)
+ *   statsd.Init(statsd.Config{Addr: agent.Addr(), Ns: "ns"})
+ * @param testing.TB $t
+ *
+ * @return *Agent
+ */
+func NewAgent(t testing.TB) *Agent {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("statsdtest: listen: %s", err.Error())
+	}
+	agent := &Agent{
+		Recorder: NewRecorder(),
+		conn:     conn,
+		done:     make(chan struct{}),
+	}
+	go agent.loop()
+	t.Cleanup(func() { agent.Close() })
+	return agent
+}
+
+func (this *Agent) loop() {
+	defer close(this.done)
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := this.conn.Read(buf)
+		if err != nil {
+			return
+		}
+		this.Recorder.Send(buf[:n])
+	}
+}
+
+// agent监听的地址, 可以直接作为 Config.Addr / WithAddr 的参数
+func (this *Agent) Addr() string {
+	return this.conn.LocalAddr().String()
+}
+
+// 停止收包, 已收到的metric仍然可以断言
+func (this *Agent) Close() error {
+	err := this.conn.Close()
+	<-this.done
+	return err
+}
@@ -0,0 +1,121 @@
+package statsdtest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	statsd "github.com/n9e/metrics-go/statsdlib"
+)
+
+func TestRecorder(t *testing.T) {
+	c, rec := New(t, statsd.WithNs("ns"))
+	tags := map[string]string{"k": "v"}
+
+	c.Counter("hit", tags)
+	c.CounterN("hit", 2, tags)
+	c.Counter("hit", map[string]string{"k": "other"})
+	c.Gauge("g", 1)
+	c.Gauge("g", 2.5)
+	c.RpcMetric("rpc", "caller", "callee", 10*time.Millisecond, "ok")
+	c.RpcMetric("rpc", "caller", "callee", 10*time.Millisecond, "error")
+
+	rec.AssertCounter(t, "ns/hit", tags, 3)
+	rec.AssertCounter(t, "ns/hit", nil, 4)
+	rec.AssertCounter(t, "hit", map[string]string{"k": "other"}, 1)
+	rec.AssertCounter(t, "other/hit", nil, 0)
+	rec.AssertGauge(t, "ns/g", nil, 2.5)
+	rec.AssertRpc(t, "ns/rpc", map[string]string{"caller": "caller", "callee": "callee"}, 2, 1)
+	if len(rec.Errors()) != 0 {
+		t.Errorf("unexpected errors: %v", rec.Errors())
+	}
+
+	rec.Reset()
+	rec.AssertEmpty(t)
+}
+
+func TestRecorderAggregation(t *testing.T) {
+	c, rec := New(t, statsd.WithNs("ns"), statsd.WithCounterAggregation(time.Hour), statsd.WithRpcAggregation(time.Hour), statsd.WithBatch(statsd.DefaultBatchMTU, time.Hour))
+	for i := 0; i < 3; i++ {
+		c.Counter("hit")
+		c.RpcMetric("rpc", "caller", "callee", time.Millisecond, "ok")
+	}
+	rec.AssertEmpty(t)
+
+	c.Flush(context.Background())
+	if rec.Len() != 2 {
+		t.Errorf("expect 2 aggregated records\n%s", rec)
+	}
+	rec.AssertCounter(t, "ns/hit", nil, 3)
+	rec.AssertRpc(t, "ns/rpc", nil, 3, 0)
+}
+
+func TestWaitFor(t *testing.T) {
+	c, rec := New(t, statsd.WithNs("ns"), statsd.WithAsync(16, statsd.DropNewest, 0))
+	for i := 0; i < 5; i++ {
+		c.Counter("hit")
+	}
+	if err := rec.WaitFor(5); err != nil {
+		t.Fatal(err)
+	}
+	rec.AssertCounter(t, "ns/hit", nil, 5)
+
+	rec.Timeout = 10 * time.Millisecond
+	if err := rec.WaitFor(6); err == nil || !strings.Contains(err.Error(), "got 5") {
+		t.Errorf("expect timeout, got %v", err)
+	}
+}
+
+func TestRecorderDecodeError(t *testing.T) {
+	rec := NewRecorder()
+	rec.Send([]byte("bad"))
+	if len(rec.Errors()) != 1 || rec.Len() != 0 {
+		t.Errorf("expect decode error, got %v\n%s", rec.Errors(), rec)
+	}
+}
+
+func TestAgent(t *testing.T) {
+	agent := NewAgent(t)
+	c, err := statsd.NewClient(statsd.WithAddr(agent.Addr()), statsd.WithNs("ns"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close(context.Background())
+
+	c.Counter("hit")
+	c.Gauge("g", 3)
+	if err := agent.WaitFor(2); err != nil {
+		t.Fatal(err)
+	}
+	agent.AssertCounter(t, "ns/hit", nil, 1)
+	agent.AssertGauge(t, "ns/g", nil, 3)
+}
+
+// 断言失败时的输出
+func TestAssertFailure(t *testing.T) {
+	c, rec := New(t, statsd.WithNs("ns"))
+	c.Counter("hit", map[string]string{"k": "v"})
+
+	ft := &fakeT{TB: t}
+	rec.AssertCounter(ft, "ns/hit", nil, 2)
+	rec.AssertGauge(ft, "ns/g", nil, 1)
+	if len(ft.errors) != 2 {
+		t.Fatalf("expect 2 failures, got %v", ft.errors)
+	}
+	if want := "counter ns/hit = 1, want 2\nreceived:\n  ns/hit{k=v} c 1"; ft.errors[0] != want {
+		t.Errorf("bad message: %q, want %q", ft.errors[0], want)
+	}
+}
+
+type fakeT struct {
+	testing.TB
+	errors []string
+}
+
+func (this *fakeT) Helper() {}
+
+func (this *fakeT) Errorf(format string, args ...interface{}) {
+	this.errors = append(this.errors, fmt.Sprintf(format, args...))
+}
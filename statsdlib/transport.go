@@ -0,0 +1,171 @@
+package statsdlib
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// 发送编码好的metric, 一次Send对应一个udp包/一帧
+// body 来自buffer池, Send 返回后不能继续持有, 需要保留时自行拷贝
+type Transport interface {
+	Send(body []byte) error
+	Close() error
+}
+
+/**
+ * @note
+ * 根据地址创建Transport, 支持:
+ *   127.0.0.1:788 或 udp://127.0.0.1:788   udp (默认)
+ *   tcp://127.0.0.1:788                    tcp, 4字节长度前缀分帧, 断线自动重连
+ *   unix:///var/run/agent.sock             unix stream, 同tcp
+ *   unixgram:///var/run/agent.sock         unix datagram
+ *   mem://                                 内存, 用于测试, 见 MemTransport
+ * @param string $addr 地址
+ *
+ * @return Transport, error
+ */
+func NewTransport(addr string) (Transport, error) {
+	scheme, target, found := strings.Cut(addr, "://")
+	if !found {
+		scheme, target = "udp", addr
+	}
+
+	switch scheme {
+	case "udp":
+		return newUDPTransport(target)
+	case "tcp", "unix":
+		return newStreamTransport(scheme, target), nil
+	case "unixgram":
+		return newUnixgramTransport(target)
+	case "mem":
+		return NewMemTransport(), nil
+	}
+	return nil, fmt.Errorf("unknown transport: %s", addr)
+}
+
+// udp
+type udpTransport struct {
+	server *net.UDPAddr
+	conn   *net.UDPConn
+}
+
+func newUDPTransport(addr string) (*udpTransport, error) {
+	server, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, fmt.Errorf("resolve metrics-agent addr error, [addr:%s][err:%s]", addr, err.Error())
+	}
+
+	local, err := net.ResolveUDPAddr("udp4", ":0")
+	if err != nil {
+		return nil, fmt.Errorf("open udp connection error, [err:%s]", err.Error())
+	}
+	conn, err := net.ListenUDP("udp4", local)
+	if err != nil {
+		return nil, fmt.Errorf("open udp connection error, [err:%s]", err.Error())
+	}
+
+	return &udpTransport{server: server, conn: conn}, nil
+}
+
+func (this *udpTransport) Send(body []byte) error {
+	_, _, err := this.conn.WriteMsgUDP(body, nil, this.server)
+	return err
+}
+
+func (this *udpTransport) Close() error {
+	return this.conn.Close()
+}
+
+// unix datagram, 写失败时下次发送重新连接
+type unixgramTransport struct {
+	mu   sync.Mutex
+	addr *net.UnixAddr
+	conn *net.UnixConn
+}
+
+func newUnixgramTransport(path string) (*unixgramTransport, error) {
+	addr, err := net.ResolveUnixAddr("unixgram", path)
+	if err != nil {
+		return nil, fmt.Errorf("resolve metrics-agent addr error, [addr:%s][err:%s]", path, err.Error())
+	}
+	return &unixgramTransport{addr: addr}, nil
+}
+
+func (this *unixgramTransport) Send(body []byte) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.conn == nil {
+		conn, err := net.DialUnix("unixgram", nil, this.addr)
+		if err != nil {
+			return err
+		}
+		this.conn = conn
+	}
+	_, err := this.conn.Write(body)
+	if err != nil {
+		this.conn.Close()
+		this.conn = nil
+	}
+	return err
+}
+
+func (this *unixgramTransport) Close() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.conn == nil {
+		return nil
+	}
+	err := this.conn.Close()
+	this.conn = nil
+	return err
+}
+
+// 内存, 记录所有发送的内容, 用于测试
+type MemTransport struct {
+	mu       sync.Mutex
+	payloads [][]byte
+	closed   bool
+}
+
+func NewMemTransport() *MemTransport {
+	return &MemTransport{}
+}
+
+func (this *MemTransport) Send(body []byte) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.closed {
+		return fmt.Errorf("transport closed")
+	}
+	this.payloads = append(this.payloads, append([]byte(nil), body...))
+	return nil
+}
+
+func (this *MemTransport) Close() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.closed = true
+	return nil
+}
+
+// 已发送内容的拷贝
+func (this *MemTransport) Payloads() [][]byte {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return append([][]byte(nil), this.payloads...)
+}
+
+// 清空已发送的内容
+func (this *MemTransport) Reset() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.payloads = nil
+}
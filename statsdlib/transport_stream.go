@@ -0,0 +1,105 @@
+package statsdlib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+/***************************************************************************
+ * tcp / unix stream: 每帧为 4字节大端长度 + 内容
+ * 连接断开后按指数退避重连, 退避期间的发送直接返回错误
+ **************************************************************************/
+const (
+	streamDialTimeout  = time.Second
+	streamWriteTimeout = time.Second
+	streamMinBackoff   = 100 * time.Millisecond
+	streamMaxBackoff   = 10 * time.Second
+)
+
+type streamTransport struct {
+	mu      sync.Mutex
+	network string
+	addr    string
+	conn    net.Conn
+	buf     []byte
+	closed  bool
+
+	backoff   time.Duration
+	nextRetry time.Time
+}
+
+func newStreamTransport(network string, addr string) *streamTransport {
+	return &streamTransport{network: network, addr: addr}
+}
+
+func (this *streamTransport) Send(body []byte) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.closed {
+		return fmt.Errorf("transport closed")
+	}
+	err := this.connect()
+	if err != nil {
+		return err
+	}
+
+	this.buf = binary.BigEndian.AppendUint32(this.buf[:0], uint32(len(body)))
+	this.buf = append(this.buf, body...)
+	this.conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	_, err = this.conn.Write(this.buf)
+	if err != nil {
+		this.conn.Close()
+		this.conn = nil
+		this.fail()
+		return err
+	}
+	return nil
+}
+
+func (this *streamTransport) connect() error {
+	if this.conn != nil {
+		return nil
+	}
+	if time.Now().Before(this.nextRetry) {
+		return fmt.Errorf("%s %s not connected, retry after %s", this.network, this.addr, this.nextRetry.Format("15:04:05.000"))
+	}
+
+	conn, err := net.DialTimeout(this.network, this.addr, streamDialTimeout)
+	if err != nil {
+		this.fail()
+		return err
+	}
+	this.conn = conn
+	this.backoff = 0
+	return nil
+}
+
+// 连接失败, 退避时间翻倍
+func (this *streamTransport) fail() {
+	if this.backoff == 0 {
+		this.backoff = streamMinBackoff
+	} else if this.backoff < streamMaxBackoff {
+		this.backoff *= 2
+		if this.backoff > streamMaxBackoff {
+			this.backoff = streamMaxBackoff
+		}
+	}
+	this.nextRetry = time.Now().Add(this.backoff)
+}
+
+func (this *streamTransport) Close() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.closed = true
+	if this.conn == nil {
+		return nil
+	}
+	err := this.conn.Close()
+	this.conn = nil
+	return err
+}
@@ -0,0 +1,151 @@
+package statsdlib
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readFrame(t *testing.T, conn net.Conn) string {
+	conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		t.Fatalf("read frame error: %s", err.Error())
+	}
+	body := make([]byte, binary.BigEndian.Uint32(head))
+	if _, err := io.ReadFull(conn, body); err != nil {
+		t.Fatalf("read frame error: %s", err.Error())
+	}
+	return string(body)
+}
+
+func TestTCPTransport(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %s", err.Error())
+	}
+	defer ln.Close()
+
+	tr, err := NewTransport("tcp://" + ln.Addr().String())
+	if err != nil {
+		t.Fatalf("new transport error: %s", err.Error())
+	}
+	defer tr.Close()
+
+	if err := tr.Send([]byte("1\nns/a\nc")); err != nil {
+		t.Fatalf("send error: %s", err.Error())
+	}
+	conn, _ := ln.Accept()
+	if body := readFrame(t, conn); body != "1\nns/a\nc" {
+		t.Errorf("bad frame: %q", body)
+	}
+	if err := tr.Send([]byte("2\nns/b\nc")); err != nil {
+		t.Fatalf("send error: %s", err.Error())
+	}
+	if body := readFrame(t, conn); body != "2\nns/b\nc" {
+		t.Errorf("bad frame: %q", body)
+	}
+
+	// 服务端断开后, 退避结束时重连
+	conn.Close()
+	st := tr.(*streamTransport)
+	for i := 0; i < 100 && st.conn != nil; i++ {
+		tr.Send([]byte("x"))
+		time.Sleep(10 * time.Millisecond)
+	}
+	st.mu.Lock()
+	st.nextRetry = time.Time{}
+	st.mu.Unlock()
+	if err := tr.Send([]byte("3\nns/c\nc")); err != nil {
+		t.Fatalf("send after reconnect error: %s", err.Error())
+	}
+	conn, _ = ln.Accept()
+	defer conn.Close()
+	if body := readFrame(t, conn); body != "3\nns/c\nc" {
+		t.Errorf("bad frame: %q", body)
+	}
+}
+
+func TestTCPTransportBackoff(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := ln.Addr().String()
+	ln.Close()
+
+	tr := newStreamTransport("tcp", addr)
+	defer tr.Close()
+	if err := tr.Send([]byte("x")); err == nil {
+		t.Fatalf("send without agent should fail")
+	}
+	if tr.backoff != streamMinBackoff {
+		t.Errorf("bad backoff: %s", tr.backoff)
+	}
+	// 退避期间不重新连接
+	tr.Send([]byte("x"))
+	if tr.backoff != streamMinBackoff {
+		t.Errorf("should not redial during backoff: %s", tr.backoff)
+	}
+}
+
+func TestUnixgramTransport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.sock")
+	agent, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("unixgram not supported: %s", err.Error())
+	}
+	defer agent.Close()
+
+	c, err := NewClient(WithAddr("unixgram://"+path), WithNs("ns"))
+	if err != nil {
+		t.Fatalf("new client error: %s", err.Error())
+	}
+	defer c.Close(context.Background())
+
+	c.Counter("a")
+	buf := make([]byte, 1024)
+	agent.SetReadDeadline(time.Now().Add(time.Second * 2))
+	n, err := agent.Read(buf)
+	if err != nil {
+		t.Fatalf("read error: %s", err.Error())
+	}
+	if string(buf[:n]) != "1\nns/a\nc" {
+		t.Errorf("bad body: %q", buf[:n])
+	}
+}
+
+func TestMemTransport(t *testing.T) {
+	tr := NewMemTransport()
+	c, err := NewClient(WithTransport(tr), WithNs("ns"))
+	if err != nil {
+		t.Fatalf("new client error: %s", err.Error())
+	}
+
+	c.Counter("a")
+	c.Gauge("b", 2)
+	payloads := tr.Payloads()
+	if len(payloads) != 2 || string(payloads[0]) != "1\nns/a\nc" || string(payloads[1]) != "2.000000\nns/b\ng" {
+		t.Errorf("bad payloads: %q", payloads)
+	}
+
+	c.Close(context.Background())
+	if err := c.Counter("a"); err == nil {
+		t.Errorf("push on closed transport should fail")
+	}
+}
+
+func TestNewTransport(t *testing.T) {
+	if _, err := NewTransport("foo://bar"); err == nil {
+		t.Errorf("unknown scheme should fail")
+	}
+	tr, err := NewTransport("127.0.0.1:788")
+	if err != nil {
+		t.Fatalf("new transport error: %s", err.Error())
+	}
+	tr.Close()
+	if _, ok := tr.(*udpTransport); !ok {
+		t.Errorf("default transport should be udp")
+	}
+}
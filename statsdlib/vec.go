@@ -0,0 +1,256 @@
+package statsdlib
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+/***************************************************************************
+ * 带固定label的metric, 声明时确定label名称, 按当前配置检查个数/长度限制,
+ * 上报时只传label的值, 避免tag key拼错和随意增加tag:
+ *   orders := statsd.NewCounterVec("orders", "region", "status")
+ *   orders.With("cn", "ok").Inc()
+ * 同一组label值的handle会被缓存, 重复 With 不分配内存;
+ * 同handle, 包级别的 NewXxxVec 跟随默认Client, 修改配置后重新检查
+ **************************************************************************/
+
+// 按label值缓存handle
+type labelVec[H any] struct {
+	client   *Client // nil时使用默认Client
+	labels   []string
+	reserved []string
+	state    atomic.Pointer[vecState[H]]
+
+	newChild func(tags map[string]string) H
+	failed   func(err error) H
+}
+
+// 绑定到某个Client后的检查结果和handle缓存, Client或配置快照变化时重新生成
+type vecState[H any] struct {
+	client *Client
+	cfg    *clientConfig
+	labels []string // reserved + 检查后的label名称
+	err    error
+
+	mu       sync.RWMutex
+	children map[string]H
+}
+
+// reserved 为固定占用的label, 如rpc的caller/callee, 值在 with 时排在最前面
+// c为nil时使用默认Client, 在第一次上报时才确定, 声明时不触发自动初始化;
+// 否则声明时就检查, 不合法的label不用等到上报才发现
+func newLabelVec[H any](c *Client, labels []string, reserved []string, newChild func(tags map[string]string) H, failed func(err error) H) *labelVec[H] {
+	v := &labelVec[H]{
+		client:   c,
+		labels:   append([]string(nil), labels...),
+		reserved: reserved,
+		newChild: newChild,
+		failed:   failed,
+	}
+	if c != nil {
+		v.bind()
+	}
+	return v
+}
+
+// 当前Client对应的检查结果, 同 handle.bind
+func (this *labelVec[H]) bind() *vecState[H] {
+	c := this.client
+	if c == nil {
+		c = defaultClient()
+	}
+	st := this.state.Load()
+	cfg := c.config()
+	if st != nil && st.client == c && st.cfg == cfg {
+		return st
+	}
+
+	clean, err := checkLabels(this.labels, this.reserved, cfg.defTags, cfg.limits, c.chars)
+	st = &vecState[H]{
+		client:   c,
+		cfg:      cfg,
+		labels:   append(append([]string(nil), this.reserved...), clean...),
+		err:      err,
+		children: map[string]H{},
+	}
+	this.state.Store(st)
+	return st
+}
+
+// 检查label名称, 宽松模式下返回替换非法字符后的名称
+// 个数包括未被label覆盖的默认tags
+func checkLabels(labels []string, reserved []string, defTags map[string]string, limits Limits, policy CharPolicy) ([]string, error) {
+	cnt := len(labels) + len(reserved)
+	for k := range defTags {
+		if !containsString(labels, k) && !containsString(reserved, k) {
+			cnt++
+		}
+	}
+	if cnt > limits.MaxTagCnt {
+		return nil, fmt.Errorf("%w: %d > %d", ErrTooManyTags, cnt, limits.MaxTagCnt)
+	}
+
+	clean := make([]string, 0, len(labels))
+	seen := map[string]bool{}
+	for _, k := range reserved {
+		seen[k] = true
+	}
+	for _, label := range labels {
+		if len(label) == 0 {
+			return nil, &TagError{Key: label, Reason: ErrEmptyTagk}
+		}
+		if len(label) > limits.MaxTagkLen {
+			return nil, &TagError{Key: label, Reason: ErrTagkTooLong}
+		}
+		k, changed := sanitizeField(label, tagIllegal)
+		if changed && policy == CharStrict {
+			return nil, &TagError{Key: label, Reason: ErrIllegalChar}
+		}
+		if seen[k] {
+			return nil, &TagError{Key: k, Reason: ErrDuplicateLabel}
+		}
+		seen[k] = true
+		clean = append(clean, k)
+	}
+	return clean, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// label值对应的handle, 值的个数必须与label个数相同
+func (this *labelVec[H]) with(values []string) H {
+	st := this.bind()
+	if st.err != nil {
+		return this.failed(st.err)
+	}
+	if len(values) != len(st.labels) {
+		return this.failed(fmt.Errorf("%w: %d, want %d", ErrLabelCount, len(values), len(st.labels)))
+	}
+
+	// key: <len>:<value>..., 不同的值不会冲突
+	buf := getBuf()
+	defer putBuf(buf)
+	key := *buf
+	for _, v := range values {
+		key = strconv.AppendInt(key, int64(len(v)), 10)
+		key = append(key, ':')
+		key = append(key, v...)
+	}
+	*buf = key
+
+	st.mu.RLock()
+	child, found := st.children[string(key)]
+	st.mu.RUnlock()
+	if found {
+		return child
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if child, found = st.children[string(key)]; found {
+		return child
+	}
+	tags := make(map[string]string, len(values))
+	for i, v := range values {
+		tags[st.labels[i]] = v
+	}
+	child = this.newChild(tags)
+	st.children[string(key)] = child
+	return child
+}
+
+// 按当前配置检查的结果, nil表示可以正常上报
+func (this *labelVec[H]) Err() error {
+	return this.bind().err
+}
+
+// counter
+type CounterVec struct {
+	*labelVec[*CounterHandle]
+}
+
+/**
+ * @note
+ * 声明带固定label的counter, 使用默认Client
+ * @param string   $metric 计数指标名称
+ * @param []string $labels label名称
+ *
+ * @return *CounterVec
+ */
+func NewCounterVec(metric string, labels ...string) *CounterVec {
+	return newCounterVec(nil, metric, labels)
+}
+
+func (this *Client) NewCounterVec(metric string, labels ...string) *CounterVec {
+	return newCounterVec(this, metric, labels)
+}
+
+func newCounterVec(c *Client, metric string, labels []string) *CounterVec {
+	return &CounterVec{newLabelVec(c, labels, nil,
+		func(tags map[string]string) *CounterHandle { return newCounter(c, metric, "c", tags) },
+		func(err error) *CounterHandle { return &CounterHandle{handle: failedHandle(c, err)} },
+	)}
+}
+
+// 按label的顺序传入值
+func (this *CounterVec) With(values ...string) *CounterHandle {
+	return this.with(values)
+}
+
+// rpc, caller/callee 固定占用两个tag
+type RpcVec struct {
+	*labelVec[*RpcHandle]
+}
+
+/**
+ * @note
+ * 声明带固定label的rpc统计, 使用默认Client
+ * @param string   $metric 指标名
+ * @param []string $labels caller/callee以外的label名称
+ *
+ * @return *RpcVec
+ */
+func NewRpcVec(metric string, labels ...string) *RpcVec {
+	return newRpcVec(nil, metric, DefaultRpcVersion, labels)
+}
+
+// 同 NewRpcVec, 使用rpce
+func NewRpcEVec(metric string, labels ...string) *RpcVec {
+	return newRpcVec(nil, metric, EnhanceRpcVersion, labels)
+}
+
+func (this *Client) NewRpcVec(metric string, labels ...string) *RpcVec {
+	return newRpcVec(this, metric, DefaultRpcVersion, labels)
+}
+
+func (this *Client) NewRpcEVec(metric string, labels ...string) *RpcVec {
+	return newRpcVec(this, metric, EnhanceRpcVersion, labels)
+}
+
+func newRpcVec(c *Client, metric string, version int, labels []string) *RpcVec {
+	return &RpcVec{newLabelVec(c, labels, []string{"caller", "callee"},
+		func(tags map[string]string) *RpcHandle {
+			caller, callee := tags["caller"], tags["callee"]
+			delete(tags, "caller")
+			delete(tags, "callee")
+			return newRpc(c, metric, caller, callee, version, tags)
+		},
+		func(err error) *RpcHandle { return &RpcHandle{handle: failedHandle(c, err)} },
+	)}
+}
+
+// 按label的顺序传入caller/callee以外的值
+func (this *RpcVec) With(caller string, callee string, values ...string) *RpcHandle {
+	var arr [16]string
+	all := append(arr[:0], caller, callee)
+	return this.with(append(all, values...))
+}
@@ -0,0 +1,158 @@
+package statsdlib
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCounterVec(t *testing.T) {
+	tr := NewMemTransport()
+	c, _ := NewClient(WithTransport(tr), WithNs("ns"))
+	defer c.Close(context.Background())
+
+	orders := c.NewCounterVec("orders", "region", "status")
+	if orders.Err() != nil {
+		t.Fatalf("unexpected error: %s", orders.Err())
+	}
+	orders.With("cn", "ok").Inc()
+	orders.With("us", "fail").Add(2)
+	if orders.With("cn", "ok") != orders.With("cn", "ok") {
+		t.Errorf("children should be cached")
+	}
+	// 长度前缀保证不同的值不冲突
+	if orders.With("a:1", "b") == orders.With("a", "1:b") {
+		t.Errorf("different values share a child")
+	}
+	if err := orders.With("cn").Inc(); err == nil {
+		t.Errorf("expect error for wrong values count")
+	}
+
+	want := []string{
+		"1\nns/orders\nregion=cn\nstatus=ok\nc",
+		"2\nns/orders\nregion=us\nstatus=fail\nc",
+	}
+	payloads := tr.Payloads()
+	if len(payloads) != len(want) {
+		t.Fatalf("bad payloads: %q", payloads)
+	}
+	for i, w := range want {
+		if string(payloads[i]) != w {
+			t.Errorf("payload %d: got %q, want %q", i, payloads[i], w)
+		}
+	}
+}
+
+func TestRpcVec(t *testing.T) {
+	tr := NewMemTransport()
+	c, _ := NewClient(WithTransport(tr), WithNs("ns"))
+	defer c.Close(context.Background())
+
+	rpc := c.NewRpcVec("rpc", "idc")
+	rpc.With("a", "b?x=1", "bj").Observe(5*time.Millisecond, "ok")
+	if p := tr.Payloads(); len(p) != 1 || string(p[0]) != "5,ok\nns/rpc\ncallee=b\ncaller=a\nidc=bj\nrpc" {
+		t.Errorf("bad payloads: %q", p)
+	}
+
+	if c.NewRpcVec("rpc", "caller").Err() == nil {
+		t.Errorf("expect error for reserved label")
+	}
+}
+
+func TestVecLimits(t *testing.T) {
+	c, _ := NewClient(WithTransport(NewMemTransport()), WithNs("ns"))
+	defer c.Close(context.Background())
+
+	bad := map[string][]string{
+		"too many":  strings.Split("a,b,c,d,e,f,g,h,i", ","),
+		"empty":     {"a", ""},
+		"too long":  {strings.Repeat("k", maxTagkLen+1)},
+		"duplicate": {"a", "a"},
+	}
+	for name, labels := range bad {
+		vec := c.NewCounterVec("m", labels...)
+		// 绑定了Client的vec声明时就已经检查
+		if st := vec.state.Load(); st == nil || st.err == nil {
+			t.Errorf("%s: expect error at declaration", name)
+		}
+		if vec.Err() == nil {
+			t.Errorf("%s: expect error", name)
+		}
+		if vec.With(labels...).Inc() == nil {
+			t.Errorf("%s: expect push error", name)
+		}
+	}
+
+	// caller/callee 占用两个tag
+	if c.NewRpcVec("rpc", strings.Split("a,b,c,d,e,f,g", ",")...).Err() == nil {
+		t.Errorf("expect too many tags for rpc vec")
+	}
+	if c.NewRpcVec("rpc", strings.Split("a,b,c,d,e,f", ",")...).Err() != nil {
+		t.Errorf("unexpected error for rpc vec")
+	}
+}
+
+// 修改限制后重新检查
+func TestVecReconfigure(t *testing.T) {
+	tr := NewMemTransport()
+	c, _ := NewClient(WithTransport(tr), WithNs("ns"), WithLimits(Limits{MaxTagCnt: 2}))
+	defer c.Close(context.Background())
+
+	vec := c.NewCounterVec("m", "a", "b", "c")
+	if !errors.Is(vec.With("1", "2", "3").Inc(), ErrTooManyTags) {
+		t.Errorf("expect too many tags: %v", vec.Err())
+	}
+	c.SetLimits(Limits{MaxTagCnt: 8})
+	if err := vec.With("1", "2", "3").Inc(); err != nil {
+		t.Errorf("unexpected error after SetLimits: %v", err)
+	}
+	c.SetLimits(Limits{MaxTagCnt: 2})
+	if vec.Err() == nil {
+		t.Errorf("expect error after lowering limits")
+	}
+	if n := len(tr.Payloads()); n != 1 {
+		t.Errorf("expect 1 payload, got %d", n)
+	}
+}
+
+// 包级别的vec在第一次上报时才确定默认Client, 声明时不触发自动初始化
+func TestVecLazyDefaultClient(t *testing.T) {
+	old := _defaultClient.Swap(nil)
+	defer _defaultClient.Store(old)
+
+	orders := NewCounterVec("orders", "region")
+	rpc := NewRpcVec("rpc", "idc")
+	if _defaultClient.Load() != nil {
+		t.Fatalf("declaring a vec should not init the default client")
+	}
+
+	tr := NewMemTransport()
+	c, _ := NewClient(WithTransport(tr), WithNs("ns"))
+	defer c.Close(context.Background())
+	_defaultClient.Store(c)
+	orders.With("cn").Inc()
+	rpc.With("a", "b", "bj").Observe(time.Millisecond, "ok")
+	if n := len(tr.Payloads()); n != 2 {
+		t.Errorf("expect 2 payloads, got %d", n)
+	}
+}
+
+func TestVecAllocs(t *testing.T) {
+	skipAllocsUnderRace(t)
+	c := newBenchClient(t)
+	defer c.Close(context.Background())
+
+	orders := c.NewCounterVec("orders", "region", "status")
+	rpc := c.NewRpcVec("rpc", "idc")
+	for name, fn := range map[string]func(){
+		"CounterVec": func() { orders.With("cn", "ok").Inc() },
+		"RpcVec":     func() { rpc.With("a", "b", "bj").Observe(time.Millisecond, "ok") },
+	} {
+		fn()
+		if allocs := testing.AllocsPerRun(100, fn); allocs != 0 {
+			t.Errorf("%s: %.1f allocs/op", name, allocs)
+		}
+	}
+}